@@ -0,0 +1,190 @@
+/* Copyright 2017 Google Inc.
+ * https://github.com/NeilFraser/CodeCity
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package coverage implements execution-coverage tracking for the
+// interpreter package.  It records, per AST node (identified by the
+// node's start offset in the original source), how many times that
+// node was reached during evaluation, at three granularities:
+// statements, branches (the arms of an if/conditional/switch) and
+// function entries.  A Coverage is inert (all Hit* calls are no-ops)
+// until Enable is called, so that embedders who don't want the
+// (small) bookkeeping overhead don't pay for it.
+package coverage
+
+import (
+	"sort"
+	"strconv"
+)
+
+// Coverage accumulates hit counts for a single run (or succession of
+// runs) of an interpreter.Interpreter.
+type Coverage struct {
+	enabled    bool
+	statements map[int]int
+	branches   map[int][]int
+	functions  map[int]int
+}
+
+// New returns a new, disabled, Coverage.
+func New() *Coverage {
+	return &Coverage{
+		statements: make(map[int]int),
+		branches:   make(map[int][]int),
+		functions:  make(map[int]int),
+	}
+}
+
+// Enable turns on hit counting.  It is irreversible: once enabled, a
+// Coverage stays enabled for the rest of its life.
+func (this *Coverage) Enable() {
+	this.enabled = true
+}
+
+// Enabled reports whether hit counting is turned on.
+func (this *Coverage) Enabled() bool {
+	return this.enabled
+}
+
+// HitStatement records that the statement starting at the given
+// source offset was entered.
+func (this *Coverage) HitStatement(start int) {
+	if !this.enabled {
+		return
+	}
+	this.statements[start]++
+}
+
+// HitBranch records that the arm-th arm (of arms total) of the
+// branching construct (IfStatement, ConditionalExpression or
+// SwitchStatement) starting at the given source offset was taken.
+// For an IfStatement or ConditionalExpression, arm 0 is the
+// consequent and arm 1 is the alternate; for a SwitchStatement, arm
+// is the index of the taken SwitchCase.
+func (this *Coverage) HitBranch(start, arm, arms int) {
+	if !this.enabled {
+		return
+	}
+	counts, ok := this.branches[start]
+	if !ok {
+		counts = make([]int, arms)
+		this.branches[start] = counts
+	}
+	counts[arm]++
+}
+
+// HitFunction records that the function starting at the given source
+// offset was entered (i.e., called).
+func (this *Coverage) HitFunction(start int) {
+	if !this.enabled {
+		return
+	}
+	this.functions[start]++
+}
+
+// StatementHits returns the number of times the statement starting at
+// the given offset has been entered.
+func (this *Coverage) StatementHits(start int) int {
+	return this.statements[start]
+}
+
+// BranchHits returns the per-arm hit counts for the branching
+// construct starting at the given offset, or nil if that construct
+// has never been reached.
+func (this *Coverage) BranchHits(start int) []int {
+	return this.branches[start]
+}
+
+// FunctionHits returns the number of times the function starting at
+// the given offset has been called.
+func (this *Coverage) FunctionHits(start int) int {
+	return this.functions[start]
+}
+
+// LineHit describes the number of times execution reached a
+// particular (line, column) position in the source.
+type LineHit struct {
+	Start  int // byte offset into the source
+	Line   int // 1-based line number
+	Column int // 0-based column number
+	Hits   int
+}
+
+// Report re-parses src only to the extent of finding line/column
+// breaks, and uses that to translate the recorded statement hit
+// counts (keyed by byte offset) into a slice of LineHit, sorted by
+// source position.  The result is suitable for driving an LCOV or
+// JSON coverage report.
+func (this *Coverage) Report(src string) []LineHit {
+	starts := lineStarts(src)
+	hits := make([]LineHit, 0, len(this.statements))
+	for start, count := range this.statements {
+		line, col := position(starts, start)
+		hits = append(hits, LineHit{Start: start, Line: line, Column: col, Hits: count})
+	}
+	sort.Slice(hits, func(i, j int) bool { return hits[i].Start < hits[j].Start })
+	return hits
+}
+
+// lineStarts returns the byte offset of the first character of each
+// line in src; starts[0] is always 0.
+func lineStarts(src string) []int {
+	starts := []int{0}
+	for i, r := range src {
+		if r == '\n' {
+			starts = append(starts, i+1)
+		}
+	}
+	return starts
+}
+
+// position converts a byte offset into a 1-based line number and
+// 0-based column number, given the line-start table returned by
+// lineStarts.
+func position(starts []int, offset int) (line, col int) {
+	// Binary search for the last line start <= offset.
+	lo, hi := 0, len(starts)-1
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		if starts[mid] <= offset {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	return lo + 1, offset - starts[lo]
+}
+
+// LCOV renders a set of LineHit as an LCOV "DA" (line coverage)
+// record block for the named source file, e.g. for concatenation
+// into a larger .info file.
+func LCOV(filename string, hits []LineHit) string {
+	seen := make(map[int]int)
+	lines := make([]int, 0, len(hits))
+	for _, h := range hits {
+		if _, ok := seen[h.Line]; !ok {
+			lines = append(lines, h.Line)
+		}
+		seen[h.Line] += h.Hits
+	}
+	sort.Ints(lines)
+
+	out := "SF:" + filename + "\n"
+	for _, line := range lines {
+		out += "DA:" + strconv.Itoa(line) + "," + strconv.Itoa(seen[line]) + "\n"
+	}
+	out += "end_of_record\n"
+	return out
+}
@@ -0,0 +1,554 @@
+/* Copyright 2017 Google Inc.
+ * https://github.com/NeilFraser/CodeCity
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package flow implements a pre-execution reachability and
+// control-flow analysis for the interpreter package, in the style of
+// Plan 9's flowEnt/flowBuf (see exp/eval/stmt.go in the Plan 9 from
+// User Space source): each statement is given a flow entry recording
+// whether it may fall through to the one that follows it, plus any
+// additional edges (jumps) it contributes - e.g. the arms of an
+// if/switch, or a labeled break/continue.  A breadth-first search
+// from the entry for PC 0 then finds every entry reachable from the
+// start of the function (or program), and anything left unvisited is
+// unreachable.
+//
+// Unlike Plan 9's eval, which assigns every statement in a function
+// a single PC in one flat array, this package gives each function (or
+// the program's top level) its own flowBuf, and a nested function
+// found while walking one is analyzed in a flowBuf of its own; jumps
+// never cross between them.
+package flow
+
+import (
+	"fmt"
+
+	"CodeCity/server/interpreter/ast"
+)
+
+// Severity classifies a Diagnostic by how serious the problem it
+// reports is.
+type Severity int
+
+const (
+	// Warning diagnostics flag code that is suspicious but not
+	// necessarily incorrect to run, such as unreachable code or a
+	// function that may fall off the end after a value-returning
+	// return elsewhere in its body.
+	Warning Severity = iota
+	// Fatal diagnostics flag code that can never execute correctly,
+	// such as a break or continue whose label does not match any
+	// enclosing statement.  See interpreter.New for how a Fatal
+	// diagnostic is used to refuse to run the program.
+	Fatal
+)
+
+// Diagnostic reports a single problem found by Analyze.
+type Diagnostic struct {
+	Severity Severity
+	Message  string
+	Start    int // byte offset, within the source, of the offending statement
+}
+
+// Analyze walks tree - the *ast.Program passed to interpreter.New -
+// building a flow graph for its top level, and for the body of every
+// (possibly nested) function declared within it, and returns the
+// diagnostics found while doing so:  unreachable statements, break or
+// continue statements with an undefined label, and functions that can
+// fall off the end after a return statement that returns a value.
+// Nodes other than *ast.Program are not analyzed, and yield no
+// diagnostics.
+func Analyze(tree ast.Node) []Diagnostic {
+	prog, ok := tree.(*ast.Program)
+	if !ok {
+		return nil
+	}
+	b := &builder{}
+	b.stmts(prog.Body)
+	b.checkUnreachable()
+	return b.diags
+}
+
+/********************************************************************/
+
+// flowEnt is one entry in a flowBuf, corresponding to a single
+// statement.
+type flowEnt struct {
+	stmt  ast.Node // the statement this entry represents; nil for a synthetic entry with no source counterpart (see builder.ifStmt and builder.tryStmt)
+	term  bool     // if true, this entry never falls through to the one following it in the same flowBuf - e.g. return, throw, or an unconditional break/continue
+	jumps []int    // indices, within the same flowBuf, of additional entries this one may transfer control to directly, besides falling through
+}
+
+// flowBuf is the flow graph for a single function body or program top
+// level: ents[i]'s fall-through successor, when !ents[i].term, is
+// ents[i+1]; jumps records any other edges.
+type flowBuf struct {
+	ents []flowEnt
+}
+
+/********************************************************************/
+
+// ctxFrame records one statement, enclosing whatever is currently
+// being walked, that a break (and, if isLoop, a continue) may target:
+// a loop, a switch, or - via an explicit label only - any other
+// labeled statement.
+type ctxFrame struct {
+	names       []string // label names that resolve to this frame; may be empty for an unlabeled loop or switch
+	isLoop      bool     // whether continue, as well as break, may target this frame
+	isSwitch    bool     // whether an unlabeled break may target this frame
+	breakIdx    []int    // indices of break entries awaiting their exit target, patched in once known
+	continueIdx []int    // indices of continue entries awaiting their "continue point" target, patched in once known
+}
+
+// builder accumulates Diagnostics while walking the statement lists of
+// a single function (or the program's top level) into buf, tracking
+// the stack of enclosing loops/switches/labels in ctx and any label
+// names awaiting attachment to the next loop or switch statement in
+// pendingLabels.
+type builder struct {
+	diags         []Diagnostic
+	buf           *flowBuf
+	ctx           []ctxFrame
+	pendingLabels []string
+}
+
+// takePendingLabels returns and clears pendingLabels, for attachment
+// to the ctxFrame of the loop or switch statement currently being
+// entered.
+func (b *builder) takePendingLabels() []string {
+	names := b.pendingLabels
+	b.pendingLabels = nil
+	return names
+}
+
+// function analyzes fn's body in a fresh flowBuf of its own, appending
+// any diagnostics found - including, unlike the top level, a Warning
+// if fn can fall off the end of its body after a return statement that
+// returns a value somewhere within it.
+func (b *builder) function(fn *ast.FunctionDeclaration) {
+	savedBuf, savedCtx := b.buf, b.ctx
+	b.buf, b.ctx = &flowBuf{}, nil
+
+	b.stmts(fn.Body.Body)
+	visited := b.checkUnreachable()
+
+	// The end of the body is reachable if the last entry is reached and
+	// falls through, or if any reached entry jumps past the last one.
+	n := len(b.buf.ents)
+	fallsOff := n > 0 && visited[n-1] && !b.buf.ents[n-1].term
+	for i, e := range b.buf.ents {
+		for _, j := range e.jumps {
+			if visited[i] && j >= n {
+				fallsOff = true
+			}
+		}
+	}
+	if fallsOff && hasValueReturn(fn.Body) {
+		name := "<anonymous>"
+		if fn.Id != nil {
+			name = fn.Id.Name
+		}
+		b.diags = append(b.diags, Diagnostic{
+			Severity: Warning,
+			Message:  fmt.Sprintf("function %q may fall off the end after a return statement that returns a value", name),
+			Start:    fn.Start(),
+		})
+	}
+
+	b.buf, b.ctx = savedBuf, savedCtx
+}
+
+// stmts appends a flow entry (or entries) to b.buf for each statement
+// in body, in order.
+func (b *builder) stmts(body ast.Statements) {
+	for _, s := range body {
+		b.stmt(s)
+	}
+}
+
+// stmt appends a flow entry (or entries) to b.buf for node, recursing
+// into any statement lists it contains; it is the flow-analysis
+// analogue of (*scope).populate1.
+func (b *builder) stmt(node ast.Node) {
+	switch n := node.(type) {
+
+	// The interesting cases:
+	case *ast.BlockStatement:
+		b.stmts(n.Body)
+	case *ast.ReturnStatement:
+		b.buf.ents = append(b.buf.ents, flowEnt{stmt: n, term: true})
+	case *ast.ThrowStatement:
+		b.buf.ents = append(b.buf.ents, flowEnt{stmt: n, term: true})
+	case *ast.BreakStatement:
+		b.jumpStmt(n, n.Label, true)
+	case *ast.ContinueStatement:
+		b.jumpStmt(n, n.Label, false)
+	case *ast.IfStatement:
+		b.ifStmt(n)
+	case *ast.ForStatement:
+		b.loopStmt(n, n.Body.S)
+	case *ast.ForInStatement:
+		b.loopStmt(n, n.Body.S)
+	case *ast.WhileStatement:
+		b.loopStmt(n, n.Body.S)
+	case *ast.DoWhileStatement:
+		b.loopStmt(n, n.Body.S)
+	case *ast.SwitchStatement:
+		b.switchStmt(n)
+	case *ast.LabeledStatement:
+		b.labeledStmt(n)
+	case *ast.TryStatement:
+		b.tryStmt(n)
+	case *ast.FunctionDeclaration:
+		// The declaration itself has no effect at the point it
+		// occurs (it was already hoisted into the enclosing scope;
+		// see scope.populate1), but its body is its own function and
+		// gets analyzed in a flowBuf of its own.
+		b.buf.ents = append(b.buf.ents, flowEnt{stmt: n})
+		b.function(n)
+	case *ast.WithStatement:
+		panic("not implemented")
+	case *ast.ExportNamedDeclaration:
+		if n.Declaration != nil {
+			b.stmt(n.Declaration)
+		}
+	case *ast.ExportDefaultDeclaration:
+		if n.Declaration != nil {
+			b.stmt(n.Declaration)
+		}
+
+	// The cases we can ignore because they have no effect on control
+	// flow:
+	case *ast.ArrayExpression, *ast.AssignmentExpression,
+		*ast.BinaryExpression, *ast.CallExpression,
+		*ast.ConditionalExpression, *ast.DebuggerStatement,
+		*ast.EmptyStatement, *ast.ExportAllDeclaration,
+		*ast.ImportDeclaration, *ast.ExpressionStatement,
+		*ast.FunctionExpression, *ast.Identifier, *ast.Literal,
+		*ast.LogicalExpression, *ast.MemberExpression,
+		*ast.NewExpression, *ast.ObjectExpression, *ast.Property,
+		*ast.SequenceExpression, *ast.ThisExpression,
+		*ast.UnaryExpression, *ast.UpdateExpression,
+		*ast.VariableDeclaration, *ast.VariableDeclarator:
+		b.buf.ents = append(b.buf.ents, flowEnt{stmt: n})
+
+	// Just in case:
+	default:
+		panic(fmt.Errorf("Unrecognized ast.Node type %T", node))
+	}
+}
+
+// ifStmt appends a flow entry for n itself - which always falls
+// through to the consequent (the next entry), and jumps to the
+// alternate (or, if there is none, to whatever follows n) - followed
+// by entries for the consequent and, if present, the alternate.  If
+// there is an alternate, a synthetic entry is inserted between the two
+// arms to represent the consequent's implicit jump past the alternate
+// once it completes, the same way a compiler would emit an
+// unconditional jump there.
+func (b *builder) ifStmt(n *ast.IfStatement) {
+	idx := len(b.buf.ents)
+	b.buf.ents = append(b.buf.ents, flowEnt{stmt: n})
+
+	b.stmt(n.Consequent.S)
+
+	if n.Alternate.S != nil {
+		skip := len(b.buf.ents)
+		b.buf.ents = append(b.buf.ents, flowEnt{term: true})
+		alt := len(b.buf.ents)
+		b.stmt(n.Alternate.S)
+		b.buf.ents[idx].jumps = []int{alt}
+		b.buf.ents[skip].jumps = []int{len(b.buf.ents)}
+	} else {
+		b.buf.ents[idx].jumps = []int{len(b.buf.ents)}
+	}
+}
+
+// loopStmt appends a flow entry for n (a for, for-in, while or
+// do-while statement), which always may fall through to whatever
+// follows it - we do not attempt to determine statically whether the
+// loop condition can ever be false, or always is - followed by the
+// entries for body.  Any break or continue found in body targeting
+// this loop is patched, once body has been fully walked, to jump to
+// the entry following the loop or back to the loop's own entry,
+// respectively.
+func (b *builder) loopStmt(n ast.Node, body ast.Node) {
+	idx := len(b.buf.ents)
+	b.buf.ents = append(b.buf.ents, flowEnt{stmt: n})
+
+	frame := ctxFrame{names: b.takePendingLabels(), isLoop: true}
+	b.ctx = append(b.ctx, frame)
+	b.stmt(body)
+	frame = b.ctx[len(b.ctx)-1]
+	b.ctx = b.ctx[:len(b.ctx)-1]
+
+	exit := len(b.buf.ents)
+	b.buf.ents[idx].jumps = []int{exit}
+	for _, i := range frame.breakIdx {
+		b.buf.ents[i].jumps = []int{exit}
+	}
+	for _, i := range frame.continueIdx {
+		b.buf.ents[i].jumps = []int{idx}
+	}
+}
+
+// switchStmt appends a flow entry for n itself - which always may
+// fall through to its first case (if any), and jumps to whatever
+// follows n, since we do not attempt to determine statically whether
+// some case always matches - followed by the entries for every
+// case's statements in turn.  Any break found among them targeting
+// this switch is patched, once they have been fully walked, to jump
+// to the entry following the switch.
+func (b *builder) switchStmt(n *ast.SwitchStatement) {
+	idx := len(b.buf.ents)
+	b.buf.ents = append(b.buf.ents, flowEnt{stmt: n})
+
+	frame := ctxFrame{names: b.takePendingLabels(), isSwitch: true}
+	b.ctx = append(b.ctx, frame)
+	for _, c := range n.Cases {
+		b.stmts(c.Consequent)
+	}
+	frame = b.ctx[len(b.ctx)-1]
+	b.ctx = b.ctx[:len(b.ctx)-1]
+
+	exit := len(b.buf.ents)
+	b.buf.ents[idx].jumps = []int{exit}
+	for _, i := range frame.breakIdx {
+		b.buf.ents[i].jumps = []int{exit}
+	}
+}
+
+// tryStmt conservatively treats a try statement as the concatenation
+// of its block, handler and finalizer, preceded by a synthetic entry
+// that falls through to the block and also jumps straight to the start
+// of the handler and of the finalizer: it does not attempt to model
+// the edges a thrown exception would actually take, since (unlike the
+// constructs above) a throw can in principle transfer control to the
+// handler from anywhere within the block, not just from its end.
+//
+// FIXME: this means a statement that is unreachable only because
+// everything that could reach it in the block always throws will not
+// be flagged; conversely nothing inside try/catch/finally is ever
+// (incorrectly) reported as following a term entry that it doesn't
+// really follow.
+func (b *builder) tryStmt(n *ast.TryStatement) {
+	idx := len(b.buf.ents)
+	b.buf.ents = append(b.buf.ents, flowEnt{})
+	b.stmt(n.Block)
+	if n.Handler != nil {
+		b.buf.ents[idx].jumps = append(b.buf.ents[idx].jumps, len(b.buf.ents))
+		b.stmt(n.Handler.Body)
+	}
+	if n.Finalizer != nil {
+		b.buf.ents[idx].jumps = append(b.buf.ents[idx].jumps, len(b.buf.ents))
+		b.stmt(n.Finalizer)
+	}
+}
+
+// labeledStmt collects n and any further LabeledStatements it wraps
+// directly into a list of label names, then walks the statement they
+// ultimately label.  If that statement is a loop or switch, the names
+// become that construct's own ctxFrame (so that continue, as well as
+// break, can use them where appropriate); otherwise a ctxFrame usable
+// only by a break naming one of these labels is pushed around it.
+func (b *builder) labeledStmt(n *ast.LabeledStatement) {
+	var names []string
+	var inner ast.Node = n
+	for {
+		ls, ok := inner.(*ast.LabeledStatement)
+		if !ok {
+			break
+		}
+		names = append(names, ls.Label.Name)
+		inner = ls.Body.S
+	}
+
+	switch inner.(type) {
+	case *ast.ForStatement, *ast.ForInStatement, *ast.WhileStatement,
+		*ast.DoWhileStatement, *ast.SwitchStatement:
+		b.pendingLabels = names
+		b.stmt(inner)
+		return
+	}
+
+	frame := ctxFrame{names: names}
+	b.ctx = append(b.ctx, frame)
+	b.stmt(inner)
+	frame = b.ctx[len(b.ctx)-1]
+	b.ctx = b.ctx[:len(b.ctx)-1]
+
+	exit := len(b.buf.ents)
+	for _, i := range frame.breakIdx {
+		b.buf.ents[i].jumps = []int{exit}
+	}
+}
+
+// jumpStmt appends a flow entry for n (a break or continue statement)
+// and, searching outward through b.ctx for a frame it may legally
+// target (an unlabeled break or continue matches the nearest loop -
+// or, for break, switch - frame; a labeled one must match a frame
+// whose names include label.Name, and, if n is a continue, must also
+// be a loop), records n's entry for that frame to patch in its target
+// once known.  If no such frame is found, n can never execute
+// correctly, and a Fatal Diagnostic is recorded instead.
+func (b *builder) jumpStmt(n ast.Node, label *ast.Identifier, isBreak bool) {
+	idx := len(b.buf.ents)
+	b.buf.ents = append(b.buf.ents, flowEnt{stmt: n, term: true})
+
+	verb := "continue"
+	if isBreak {
+		verb = "break"
+	}
+
+	for i := len(b.ctx) - 1; i >= 0; i-- {
+		f := &b.ctx[i]
+		if label != nil {
+			if !containsName(f.names, label.Name) {
+				continue
+			}
+		} else if !f.isLoop && !(isBreak && f.isSwitch) {
+			continue
+		}
+		if !isBreak && !f.isLoop {
+			// continue, whether labeled or not, must still target a
+			// loop; a label naming some other statement (e.g. a
+			// plain block) cannot be continue's target.
+			continue
+		}
+		if isBreak {
+			f.breakIdx = append(f.breakIdx, idx)
+		} else {
+			f.continueIdx = append(f.continueIdx, idx)
+		}
+		return
+	}
+
+	var msg string
+	if label != nil {
+		msg = fmt.Sprintf("%s %s: label %q is not defined", verb, label.Name, label.Name)
+	} else {
+		msg = fmt.Sprintf("Illegal %s statement: not inside a loop%s", verb, map[bool]string{true: " or switch", false: ""}[isBreak])
+	}
+	b.diags = append(b.diags, Diagnostic{Severity: Fatal, Message: msg, Start: n.Start()})
+}
+
+func containsName(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// hasValueReturn reports whether node (which must not itself be a
+// nested function) contains, anywhere within it, a return statement
+// that returns a value, i.e. one whose completion, if reached, would
+// not itself leave the enclosing function's return value as
+// undefined.
+func hasValueReturn(node ast.Node) bool {
+	switch n := node.(type) {
+	case *ast.ReturnStatement:
+		return n.Argument.E != nil
+	case *ast.BlockStatement:
+		for _, s := range n.Body {
+			if hasValueReturn(s) {
+				return true
+			}
+		}
+	case *ast.IfStatement:
+		if hasValueReturn(n.Consequent.S) {
+			return true
+		}
+		return n.Alternate.S != nil && hasValueReturn(n.Alternate.S)
+	case *ast.ForStatement:
+		return hasValueReturn(n.Body.S)
+	case *ast.ForInStatement:
+		return hasValueReturn(n.Body.S)
+	case *ast.WhileStatement:
+		return hasValueReturn(n.Body.S)
+	case *ast.DoWhileStatement:
+		return hasValueReturn(n.Body.S)
+	case *ast.SwitchStatement:
+		for _, c := range n.Cases {
+			for _, s := range c.Consequent {
+				if hasValueReturn(s) {
+					return true
+				}
+			}
+		}
+	case *ast.TryStatement:
+		if hasValueReturn(n.Block) {
+			return true
+		}
+		if n.Handler != nil && hasValueReturn(n.Handler.Body) {
+			return true
+		}
+		return n.Finalizer != nil && hasValueReturn(n.Finalizer)
+	case *ast.LabeledStatement:
+		return hasValueReturn(n.Body.S)
+	}
+	// Anything else - including a nested FunctionDeclaration, whose
+	// return statements belong to it, not to the function we are
+	// checking - has no return statements of our function's own.
+	return false
+}
+
+/********************************************************************/
+
+// checkUnreachable runs a breadth-first search of b.buf starting from
+// entry 0, appends a Warning Diagnostic for every entry not reached -
+// except a synthetic one, which has no source statement to report -
+// and returns the resulting visited slice (indexed the same as
+// b.buf.ents) for the caller's own use.
+func (b *builder) checkUnreachable() []bool {
+	ents := b.buf.ents
+	visited := make([]bool, len(ents))
+	if len(ents) == 0 {
+		return visited
+	}
+
+	queue := []int{0}
+	visited[0] = true
+	for len(queue) > 0 {
+		i := queue[0]
+		queue = queue[1:]
+		e := ents[i]
+
+		var next []int
+		if !e.term && i+1 < len(ents) {
+			next = append(next, i+1)
+		}
+		next = append(next, e.jumps...)
+
+		for _, j := range next {
+			if j >= 0 && j < len(ents) && !visited[j] {
+				visited[j] = true
+				queue = append(queue, j)
+			}
+		}
+	}
+
+	for i, e := range ents {
+		if !visited[i] && e.stmt != nil {
+			b.diags = append(b.diags, Diagnostic{
+				Severity: Warning,
+				Message:  "unreachable statement",
+				Start:    e.stmt.Start(),
+			})
+		}
+	}
+	return visited
+}
@@ -19,8 +19,11 @@ package interpreter
 
 import (
 	"fmt"
+	"strings"
 
 	"CodeCity/server/interpreter/ast"
+	"CodeCity/server/interpreter/coverage"
+	"CodeCity/server/interpreter/flow"
 	"CodeCity/server/interpreter/object"
 )
 
@@ -29,18 +32,78 @@ type Interpreter struct {
 	state   state
 	value   object.Value
 	Verbose bool
+
+	// Coverage records statement, branch and function hit counts as
+	// the program is evaluated.  It is present (never nil) but inert
+	// until its Enable method is called.
+	Coverage *coverage.Coverage
+
+	// Diagnostics holds the reachability and control-flow problems
+	// (see package flow) found in the program by New before it was
+	// ever run.  If any of them is flow.Fatal, the program was never
+	// actually started: Step returns false and Run returns (false,
+	// nil) immediately, as though it had already terminated.
+	Diagnostics []flow.Diagnostic
+
+	// Threw records whether the program's outermost statement list
+	// ended by running off the end of an uncaught throw, as opposed to
+	// completing normally.  When true, Value holds the thrown value
+	// rather than the last expression statement's value.
+	Threw bool
+
+	// Loader resolves and loads the source of modules imported by a
+	// program created with NewModule.  It is nil for an Interpreter
+	// created with New.
+	Loader ModuleLoader
+
+	// Interrupt, if non-nil, is polled (without blocking) by Step
+	// before each statement step: a function sent on the channel is
+	// invoked right there, ahead of that step.  This lets an embedder
+	// halt a long-running or runaway program - e.g. to enforce a
+	// wall-clock or step-count budget on untrusted code - without
+	// forking the interpreter loop or killing the goroutine it runs
+	// on, in the spirit of otto's runtime.Interrupt.  To actually halt
+	// execution the function must panic; a function that returns
+	// normally merely lets the pending step proceed as usual.  Run
+	// recovers such a panic and returns it as the
+	// program's abnormal completion value rather than letting it
+	// escape to the embedder.
+	Interrupt chan func()
+
+	// origJSON retains the astJSON passed to New, so that Snapshot can
+	// embed it and Restore can re-parse it to recover the AST nodes
+	// that in-flight states reference; see snapshot.go.  It is unset
+	// (and Snapshot refuses to run) for an Interpreter created via
+	// NewModule, whose multi-module source graph snapshotting is not
+	// yet supported.
+	origJSON string
 }
 
 // New takes a JavaScript program, in the form of an JSON-encoded
 // ESTree, and creates a new Interpreter that will execute that
 // program.
+//
+// Before doing so, New runs the program through flow.Analyze and
+// records whatever it finds in Diagnostics; if any of those
+// diagnostics is flow.Fatal (e.g. a break or continue with an
+// undefined label), New still returns an Interpreter, but one that
+// will refuse to take any steps - see Diagnostics - rather than
+// running code known to be broken.
 func New(astJSON string) *Interpreter {
 	var this = new(Interpreter)
 
+	this.Coverage = coverage.New()
+	this.origJSON = astJSON
 	tree, err := ast.NewFromJSON(astJSON)
 	if err != nil {
 		panic(err)
 	}
+	this.Diagnostics = flow.Analyze(tree)
+	for _, d := range this.Diagnostics {
+		if d.Severity == flow.Fatal {
+			return this
+		}
+	}
 	s := newScope(nil, this)
 	// FIXME: insert global names into s
 	s.populate(tree)
@@ -50,10 +113,22 @@ func New(astJSON string) *Interpreter {
 
 // Step performs the next step in the evaluation of program.  Returns
 // true if a step was executed; false if the program has terminated.
+//
+// If Interrupt is non-nil, Step polls it (without blocking) before
+// taking its step, and calls a function received from it immediately;
+// such a function must panic to actually prevent the step that
+// follows from running.
 func (this *Interpreter) Step() bool {
 	if this.state == nil {
 		return false
 	}
+	if this.Interrupt != nil {
+		select {
+		case fn := <-this.Interrupt:
+			this.callInterrupt(fn)
+		default:
+		}
+	}
 	if this.Verbose {
 		fmt.Printf("Next step is a %T\n", this.state)
 	}
@@ -61,12 +136,48 @@ func (this *Interpreter) Step() bool {
 	return true
 }
 
-// Run runs the program to completion.
-func (this *Interpreter) Run() {
+// Run runs the program to completion.  If a function received from
+// Interrupt panics, Run recovers that panic and returns it as the
+// program's abnormal completion value, with interrupted set to true;
+// Value() reflects whatever had been computed up to that point.
+// Otherwise Run returns (false, nil) once the program terminates
+// normally.  A panic not raised by an Interrupt function (i.e. an
+// internal interpreter error) is not recovered; it propagates to
+// Run's caller as usual.
+func (this *Interpreter) Run() (interrupted bool, value interface{}) {
+	defer func() {
+		if r := recover(); r != nil {
+			ip, ok := r.(interruptPanic)
+			if !ok {
+				panic(r)
+			}
+			interrupted = true
+			value = ip.value
+		}
+	}()
 	for this.Step() {
 	}
+	return false, nil
 }
 
+// callInterrupt invokes fn, the function just received from
+// Interrupt, tagging any panic it raises as an interruptPanic so that
+// Run can recover it specifically, without also catching unrelated
+// internal interpreter panics.
+func (this *Interpreter) callInterrupt(fn func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			panic(interruptPanic{r})
+		}
+	}()
+	fn()
+}
+
+// interruptPanic wraps the panic value raised by a function received
+// from Interrupt, distinguishing it (for the purposes of Run's
+// recover) from a panic raised anywhere else in the interpreter.
+type interruptPanic struct{ value interface{} }
+
 // Value returns the final value computed by the last statement
 // expression of the program.
 func (this *Interpreter) Value() object.Value {
@@ -82,14 +193,46 @@ func (this *Interpreter) acceptValue(v object.Value) {
 	this.value = v
 }
 
+// acceptCompletion receives the completion record of the program's
+// outermost statement list once it is done.  A normal completion
+// needs no further action: Value already holds whatever the last
+// ExpressionStatement produced, via acceptValue.  A return or throw
+// reaching all the way out here - the former only possible for a
+// program consisting of a bare function body, since there is not yet
+// any way to call a function - instead makes its value the program's
+// Value, with Threw recording which of the two it was.  An uncaught
+// break or continue is not something a well-formed program can
+// produce: flow.Analyze rejects any of those whose label (if any)
+// does not resolve to an enclosing loop, switch or labeled statement,
+// so seeing one here means New failed to catch a bug in flow.Analyze
+// itself.
+func (this *Interpreter) acceptCompletion(c completion) {
+	switch c.typ {
+	case completionNormal:
+	case completionReturn, completionThrow:
+		this.value = c.value
+		this.Threw = c.typ == completionThrow
+	default:
+		panic(fmt.Errorf("uncaught break/continue completion (label %q)", c.label))
+	}
+}
+
 /********************************************************************/
 
 // scope implements JavaScript (block) scope; it's basically just a
-// mapping of declared variable names to values, with two additions:
+// mapping of declared variable names to bindings, with some
+// additions:
 //
 // - parent is a pointer to the parent scope (if nil then this is the
 // global scope)
 //
+// - funcScope is a pointer to the nearest enclosing function (or
+// global/module) scope, i.e. the scope that hoisted var and
+// FunctionDeclaration bindings attach to, as opposed to this (which
+// is where let/const bindings declared directly in this block
+// attach).  It is this, rather than parent, for any scope that is
+// itself a function/global/module scope.
+//
 // - interpreter is a pointer to the interpreter that this scope
 // belongs to.  It is provided so that stateExpressionStatement can
 // send a completion value to the interpreter, which is useful for
@@ -100,102 +243,253 @@ func (this *Interpreter) acceptValue(v object.Value) {
 //
 // FIXME: readonly flag?  Or readonly if parent == nil?
 type scope struct {
-	vars        map[string]object.Value
+	vars        map[string]*binding
 	parent      *scope
+	funcScope   *scope
 	interpreter *Interpreter
 }
 
+// binding is a single declared variable: its current value, and the
+// kind of declaration that introduced it, which governs where it
+// hoists to (see scope.populate) and whether it may be reassigned
+// (see scope.setVar).
+type binding struct {
+	value object.Value
+	kind  bindingKind
+}
+
+// bindingKind identifies the declaration form responsible for a
+// binding.
+type bindingKind int
+
+const (
+	bindingVar bindingKind = iota
+	bindingLet
+	bindingConst
+	bindingFunction
+)
+
 // newScope is a factory for scope objects.  The parent param is a
-// pointer to the parent (enclosing scope); it is nil if the scope
-// being created is the global scope.  The interpreter param is a
+// pointer to the parent (enclosing) scope; it is nil only for a
+// program or module's outermost scope, which is its own funcScope.
+// Every other scope - currently the child scope stateBlockStatement
+// pushes for a nested block, and the one stateTryStatement pushes
+// for a catch clause's parameter - inherits its
+// funcScope from parent, since a block does not establish a new
+// var-hoisting target of its own.  The interpreter param is a
 // pointer to the interpreter this scope belongs to.
 func newScope(parent *scope, interpreter *Interpreter) *scope {
-	return &scope{make(map[string]object.Value), parent, interpreter}
+	s := &scope{vars: make(map[string]*binding), parent: parent, interpreter: interpreter}
+	if parent != nil {
+		s.funcScope = parent.funcScope
+	} else {
+		s.funcScope = s
+	}
+	return s
 }
 
-// setVar sets the named variable to the specified value, after
-// first checking that it exists.
-//
-// FIXME: this should probably recurse if name is not found in current
-// scope - but not when called from stateVariableDeclarator, which
-// should never be setting variables other than in the
-// immediately-enclosing scope.
+// setVar sets the named variable to the specified value, searching
+// outward through enclosing scopes for its declaration (since e.g. a
+// var declared in an outer function scope may be set from a nested
+// block), and throws a JS TypeError if the binding found turns out to
+// be a const.  It is used for ordinary (re-)assignment, as opposed to
+// a declaration's own initialization; see initVar for that.
 func (this *scope) setVar(name string, value object.Value) {
-	_, ok := this.vars[name]
-	if !ok {
-		panic(fmt.Errorf("can't set undeclared variable %v", name))
+	for s := this; s != nil; s = s.parent {
+		b, ok := s.vars[name]
+		if !ok {
+			continue
+		}
+		if b.kind == bindingConst {
+			panic(&object.ErrorMsg{
+				Name:    "TypeError",
+				Message: fmt.Sprintf("Assignment to constant variable %q.", name),
+			})
+		}
+		b.value = value
+		return
 	}
-	this.vars[name] = value
+	panic(&object.ErrorMsg{
+		Name:    "ReferenceError",
+		Message: fmt.Sprintf("%s is not defined", name),
+	})
+}
+
+// initVar gives a var/let/const binding its initial value: it is what
+// stateVariableDeclarator uses to evaluate a declaration's own
+// initializer, which - unlike a later assignment via setVar - is
+// permitted even for a const.  Like setVar, it searches outward
+// through enclosing scopes, since a var's binding may in fact live in
+// an enclosing function scope rather than this one.
+func (this *scope) initVar(name string, value object.Value) {
+	for s := this; s != nil; s = s.parent {
+		if b, ok := s.vars[name]; ok {
+			b.value = value
+			return
+		}
+	}
+	panic(&object.ErrorMsg{
+		Name:    "ReferenceError",
+		Message: fmt.Sprintf("%s is not defined", name),
+	})
 }
 
-// getVar gets the current value of the specified variable, after
-// first checking that it exists.
-//
-// FIXME: this should probably recurse if name is not found in current
-// scope.
+// getVar gets the current value of the specified variable, searching
+// outward through enclosing scopes if it is not found locally.
 func (this *scope) getVar(name string) object.Value {
-	v, ok := this.vars[name]
-	if !ok {
-		// FIXME: should probably throw
-		panic(fmt.Errorf("can't get undeclared variable %v", name))
+	for s := this; s != nil; s = s.parent {
+		if b, ok := s.vars[name]; ok {
+			return b.value
+		}
 	}
-	return v
+	panic(&object.ErrorMsg{
+		Name:    "ReferenceError",
+		Message: fmt.Sprintf("%s is not defined", name),
+	})
+}
+
+// declare creates, in this scope, a new binding named name of the
+// given kind, as part of the hoisting performed by populate.  It
+// throws a JS SyntaxError if that would conflict with a binding
+// already declared (by anything) in this scope: let and const may
+// never be redeclared, but var and function may be (by themselves or
+// each other) any number of times.
+func (this *scope) declare(name string, kind bindingKind) {
+	if old, ok := this.vars[name]; ok {
+		if old.kind == bindingLet || old.kind == bindingConst ||
+			kind == bindingLet || kind == bindingConst {
+			panic(&object.ErrorMsg{
+				Name:    "SyntaxError",
+				Message: fmt.Sprintf("Identifier %q has already been declared", name),
+			})
+		}
+	}
+	this.vars[name] = &binding{value: object.Undefined{}, kind: kind}
 }
 
+// populate walks node - normally the Program or module whose outer
+// scope this is - registering the bindings it hoists: every var and
+// FunctionDeclaration binding, found no matter how deeply nested
+// (short of crossing into a nested function body, which populates its
+// own scope when called), attaches to this.funcScope; every
+// let/const binding that is a direct child of node attaches to this
+// instead, matching the block-level environment model used by (e.g.)
+// esbuild's js_parser and otto.
+//
+// populate is also called, with a freshly-created scope and a
+// *ast.BlockStatement for node, each time stateBlockStatement pushes a
+// child scope for a nested block at runtime: a let/const found while
+// recursing through such a nested block belongs to that block's own
+// (not yet created) scope, so populate does not declare it here.
+//
+// node's own statement list is special-cased here, rather than being
+// left to populate1's generic *ast.BlockStatement case, because that
+// case is also reached when a bare nested block statement turns up
+// while hoisting var/function declarations through an ancestor scope -
+// and in that situation direct must be false, to keep the nested
+// block's own let/const out of the ancestor scope.  Only this, the
+// entry call, may hoist node's top-level let/const directly into
+// this scope.
 func (this *scope) populate(node ast.Node) {
+	if n, ok := node.(*ast.BlockStatement); ok {
+		for _, s := range n.Body {
+			this.populate1(s, true)
+		}
+		return
+	}
+	this.populate1(node, true)
+}
+
+// populate1 is the recursive implementation of populate; direct is
+// true only for nodes that are part of the statement list owned by
+// this scope itself (as opposed to a nested block reached while
+// hoisting var/function declarations through it).
+func (this *scope) populate1(node ast.Node, direct bool) {
 	switch n := node.(type) {
 
 	// The interesting cases:
-	case *ast.VariableDeclarator:
-		this.vars[n.Id.Name] = object.Undefined{}
+	case *ast.VariableDeclaration:
+		switch n.Kind {
+		case "var":
+			for _, d := range n.Declarations {
+				this.funcScope.declare(d.Id.Name, bindingVar)
+			}
+		case "let", "const":
+			if !direct {
+				return
+			}
+			kind := bindingLet
+			if n.Kind == "const" {
+				kind = bindingConst
+			}
+			for _, d := range n.Declarations {
+				this.declare(d.Id.Name, kind)
+			}
+		default:
+			panic(fmt.Errorf("Unknown VariableDeclaration kind %q", n.Kind))
+		}
 	case *ast.FunctionDeclaration:
-		// Add name of function to scope; ignore contents.
-		this.vars[n.Id.Name] = object.Undefined{}
+		// Add name of function to the enclosing function scope;
+		// ignore contents.
+		this.funcScope.declare(n.Id.Name, bindingFunction)
 
 	// The recursive cases:
 	case *ast.BlockStatement:
+		// A bare nested block statement always gets its own child
+		// scope at runtime (see stateBlockStatement.init), so its
+		// let/const never belongs to this scope - unlike populate's
+		// entry call, which handles node's own top-level statements
+		// before ever reaching this case.
 		for _, s := range n.Body {
-			this.populate(s)
+			this.populate1(s, false)
 		}
 	case *ast.CatchClause:
-		this.populate(n.Body)
+		this.populate1(n.Body, false)
 	case *ast.DoWhileStatement:
-		this.populate(n.Body.S)
+		this.populate1(n.Body.S, false)
 	case *ast.ForInStatement:
-		this.populate(n.Left.N)
-		this.populate(n.Body.S)
+		this.populate1(n.Left.N, false)
+		this.populate1(n.Body.S, false)
 	case *ast.ForStatement:
-		this.populate(n.Init.N)
-		this.populate(n.Body.S)
+		this.populate1(n.Init.N, false)
+		this.populate1(n.Body.S, false)
 	case *ast.IfStatement:
-		this.populate(n.Consequent.S)
-		this.populate(n.Alternate.S)
+		this.populate1(n.Consequent.S, false)
+		this.populate1(n.Alternate.S, false)
 	case *ast.LabeledStatement:
-		this.populate(n.Body.S)
+		this.populate1(n.Body.S, false)
 	case *ast.Program:
 		for _, s := range n.Body {
-			this.populate(s)
+			this.populate1(s, direct)
 		}
 	case *ast.SwitchCase:
 		for _, s := range n.Consequent {
-			this.populate(s)
+			this.populate1(s, false)
 		}
 	case *ast.SwitchStatement:
 		for _, c := range n.Cases {
-			this.populate(c)
+			this.populate1(c, false)
 		}
 	case *ast.TryStatement:
-		this.populate(n.Block)
-		this.populate(n.Handler)
-		this.populate(n.Finalizer)
-	case *ast.VariableDeclaration:
-		for _, d := range n.Declarations {
-			this.populate(d)
-		}
+		this.populate1(n.Block, false)
+		this.populate1(n.Handler, false)
+		this.populate1(n.Finalizer, false)
 	case *ast.WhileStatement:
-		this.populate(n.Body.S)
+		this.populate1(n.Body.S, false)
 	case *ast.WithStatement:
 		panic("not implemented")
+	case *ast.ExportNamedDeclaration:
+		if n.Declaration != nil {
+			this.populate1(n.Declaration, direct)
+		}
+	case *ast.ExportDefaultDeclaration:
+		if n.Declaration != nil {
+			this.populate1(n.Declaration, direct)
+		}
+		// The default export itself is bound under this reserved
+		// name (see moduleRecord.exports in module.go), regardless
+		// of whether Declaration also introduces a name of its own.
+		this.funcScope.declare("*default*", bindingConst)
 
 	// The cases we can ignore because they cannot contain
 	// declarations:
@@ -208,6 +502,8 @@ func (this *scope) populate(node ast.Node) {
 	case *ast.ContinueStatement:
 	case *ast.DebuggerStatement:
 	case *ast.EmptyStatement:
+	case *ast.ExportAllDeclaration:
+	case *ast.ImportDeclaration:
 	case *ast.ExpressionStatement:
 	case *ast.FunctionExpression:
 	case *ast.Identifier:
@@ -257,11 +553,53 @@ type valueAcceptor interface {
 	acceptValue(object.Value)
 }
 
+// completionType classifies how a statement's evaluation completed,
+// mirroring the ECMAScript notion of a completion record (see e.g.
+// otto's valueResult/evaluateBreak handling in
+// cmpl_evaluate_statement.go).
+type completionType int
+
+const (
+	completionNormal completionType = iota
+	completionBreak
+	completionContinue
+	completionReturn
+	completionThrow
+)
+
+// completion is the result of executing a single statement: whether
+// it ran to completion or completed abruptly via break, continue,
+// return or throw; the value it is carrying, if any (the argument of
+// a return or throw; unused, and object.Undefined{}, for the others);
+// and, for a break or continue, the label it targets, or "" for an
+// unlabeled one.
+type completion struct {
+	typ   completionType
+	value object.Value
+	label string
+}
+
+// completionAcceptor is implemented by any state that is the parent
+// of a statement - stateBlockStatement, stateLabeledStatement,
+// stateTryStatement, and (via Interpreter.acceptCompletion) the
+// Interpreter itself, for the outermost program - and so must be told
+// how that statement completed, in order to decide whether to consume
+// it or propagate it further up.  It is to statement completions what
+// valueAcceptor is to expression values; see stateCommon.complete.
+type completionAcceptor interface {
+	acceptCompletion(completion)
+}
+
 // newState creates a state object corresponding to the given AST
 // node.  The parent parameter represents the state the interpreter
 // should return to after evaluating the tree rooted at node.
 func newState(parent state, scope *scope, node ast.Node) state {
 	var sc = stateCommon{parent, scope}
+	if cov := scope.interpreter.Coverage; cov.Enabled() {
+		if isStatementNode(node) {
+			cov.HitStatement(node.Start())
+		}
+	}
 	switch n := node.(type) {
 	case *ast.AssignmentExpression:
 		s := stateAssignmentExpression{stateCommon: sc}
@@ -275,10 +613,18 @@ func newState(parent state, scope *scope, node ast.Node) state {
 		s := stateBlockStatement{stateCommon: sc}
 		s.init(n)
 		return &s
+	case *ast.BreakStatement:
+		s := stateBreakStatement{stateCommon: sc}
+		s.init(n)
+		return &s
 	case *ast.ConditionalExpression:
 		s := stateConditionalExpression{stateCommon: sc}
 		s.init(n)
 		return &s
+	case *ast.ContinueStatement:
+		s := stateContinueStatement{stateCommon: sc}
+		s.init(n)
+		return &s
 	case *ast.EmptyStatement:
 		s := stateEmptyStatement{stateCommon: sc}
 		s.init(n)
@@ -299,6 +645,10 @@ func newState(parent state, scope *scope, node ast.Node) state {
 		s := stateIfStatement{stateCommon: sc}
 		s.init(n)
 		return &s
+	case *ast.LabeledStatement:
+		s := stateLabeledStatement{stateCommon: sc}
+		s.init(n)
+		return &s
 	case *ast.Literal:
 		s := stateLiteral{stateCommon: sc}
 		s.init(n)
@@ -311,6 +661,22 @@ func newState(parent state, scope *scope, node ast.Node) state {
 		s := stateBlockStatement{stateCommon: sc}
 		s.initFromProgram(n)
 		return &s
+	case *ast.ReturnStatement:
+		s := stateReturnStatement{stateCommon: sc}
+		s.init(n)
+		return &s
+	case *ast.ThrowStatement:
+		s := stateThrowStatement{stateCommon: sc}
+		s.init(n)
+		return &s
+	case *ast.TryStatement:
+		s := stateTryStatement{stateCommon: sc}
+		s.init(n)
+		return &s
+	case *ast.UpdateExpression:
+		s := stateUpdateExpression{stateCommon: sc}
+		s.init(n)
+		return &s
 	case *ast.VariableDeclaration:
 		s := stateVariableDeclaration{stateCommon: sc}
 		s.init(n)
@@ -324,6 +690,35 @@ func newState(parent state, scope *scope, node ast.Node) state {
 	}
 }
 
+// isStatementNode reports whether node is one of the ast.*Statement
+// types (as opposed to an ast.*Expression), for the purposes of
+// coverage.Coverage.HitStatement.  ast.Program is excluded: coverage
+// is concerned with the statements inside the program, not the
+// program itself.
+//
+// FIXME: this should probably be a method on ast.Node (or ast could
+// export a Statement marker interface) rather than a type switch
+// that has to be kept in sync with newState's.
+func isStatementNode(node ast.Node) bool {
+	switch node.(type) {
+	case *ast.BlockStatement:
+	case *ast.BreakStatement:
+	case *ast.ContinueStatement:
+	case *ast.EmptyStatement:
+	case *ast.ExpressionStatement:
+	case *ast.FunctionDeclaration:
+	case *ast.IfStatement:
+	case *ast.LabeledStatement:
+	case *ast.ReturnStatement:
+	case *ast.ThrowStatement:
+	case *ast.TryStatement:
+	case *ast.VariableDeclaration:
+	default:
+		return false
+	}
+	return true
+}
+
 /********************************************************************/
 
 // stateCommon is a struct, intended to be embedded in most or all
@@ -340,6 +735,37 @@ type stateCommon struct {
 	scope *scope
 }
 
+// complete reports that the statement owning this stateCommon has
+// finished, with completion c, to whatever is watching for it - our
+// parent, if it implements completionAcceptor (as stateBlockStatement,
+// stateLabeledStatement and stateTryStatement all do) - or, if parent
+// is nil (we are the outermost statement of the program), the
+// Interpreter itself.  It returns the state the driver loop should
+// transition to next, so that callers can simply
+//
+//	return this.complete(c)
+//
+// the same way a valueAcceptor's caller would `return this.parent`
+// right after calling acceptValue.
+func (this *stateCommon) complete(c completion) state {
+	if this.parent == nil {
+		this.scope.interpreter.acceptCompletion(c)
+		return nil
+	}
+	if ca, ok := this.parent.(completionAcceptor); ok {
+		ca.acceptCompletion(c)
+	}
+	return this.parent
+}
+
+// completeNormal is shorthand for complete with a normal completion;
+// it is what every statement state that cannot itself complete
+// abruptly (i.e., anything but break, continue, return and throw)
+// should return from step() once it is done.
+func (this *stateCommon) completeNormal() state {
+	return this.complete(completion{typ: completionNormal})
+}
+
 /********************************************************************/
 
 type stateAssignmentExpression struct {
@@ -367,7 +793,14 @@ func (this *stateAssignmentExpression) step() state {
 	if !this.left.ready {
 		panic("lvalue not ready???")
 	}
-	this.left.set(this.right)
+	v := this.right
+	if this.op != "=" {
+		// A compound assignment (+=, -=, etc.): apply the
+		// corresponding binary operator to the lvalue's current value
+		// and the right-hand side before assigning the result.
+		v = evalBinaryOp(strings.TrimSuffix(this.op, "="), this.left.get(), this.right)
+	}
+	this.left.set(v)
 
 	return this.parent
 }
@@ -401,29 +834,37 @@ func (this *stateBinaryExpression) step() state {
 		return newState(this, this.scope, ast.Node(this.rNode.E))
 	}
 
-	// FIXME: implement other operators, types
+	v := evalBinaryOp(this.op, this.left, this.right)
+	this.parent.(valueAcceptor).acceptValue(v)
+	return this.parent
 
-	var v object.Value
-	switch this.op {
+}
+
+// evalBinaryOp computes the result of applying a binary arithmetic
+// operator to two already-evaluated operands.  It is factored out of
+// stateBinaryExpression.step so that stateAssignmentExpression can
+// reuse it for compound assignments (+=, -=, etc.), which are
+// evaluated as a binary operation between the lvalue's current value
+// and the right-hand side, followed by an assignment of the result.
+//
+// FIXME: implement other operators, types
+func evalBinaryOp(op string, left, right object.Value) object.Value {
+	switch op {
 	case "+":
-		v = object.Number(this.left.(object.Number) +
-			this.right.(object.Number))
+		return object.Number(left.(object.Number) +
+			right.(object.Number))
 	case "-":
-		v = object.Number(this.left.(object.Number) -
-			this.right.(object.Number))
+		return object.Number(left.(object.Number) -
+			right.(object.Number))
 	case "*":
-		v = object.Number(this.left.(object.Number) *
-			this.right.(object.Number))
+		return object.Number(left.(object.Number) *
+			right.(object.Number))
 	case "/":
-		v = object.Number(this.left.(object.Number) /
-			this.right.(object.Number))
+		return object.Number(left.(object.Number) /
+			right.(object.Number))
 	default:
 		panic("not implemented")
 	}
-
-	this.parent.(valueAcceptor).acceptValue(v)
-	return this.parent
-
 }
 
 func (this *stateBinaryExpression) acceptValue(v object.Value) {
@@ -445,32 +886,80 @@ func (this *stateBinaryExpression) acceptValue(v object.Value) {
 
 type stateBlockStatement struct {
 	stateCommon
-	body  ast.Statements
-	value object.Value
-	n     int
+	body    ast.Statements
+	outer   *scope // this.scope, as it was before block entry pushed a child scope
+	value   object.Value
+	n       int
+	pending completion // outcome of the most recently run statement
 }
 
 func (this *stateBlockStatement) initFromProgram(node *ast.Program) {
 	this.body = node.Body
 }
 
+// init sets up evaluation of a genuine block (as opposed to a
+// Program, which uses initFromProgram): it pushes a fresh child scope
+// for the block's own let/const bindings, analogous to the
+// block-level environment model used by (e.g.) esbuild's js_parser
+// and otto.  step pops this scope again once the block's statements
+// have all been run.
 func (this *stateBlockStatement) init(node *ast.BlockStatement) {
 	this.body = node.Body
+	this.outer = this.scope
+	block := newScope(this.scope, this.scope.interpreter)
+	block.populate(node)
+	this.scope = block
 }
 
+// step runs the block's statements in order, stopping early - without
+// running any further ones - the moment one of them completes
+// abruptly, as recorded in this.pending by acceptCompletion; either
+// way, once the block is done, its own completion (normal, if every
+// statement was, or whichever one wasn't) is reported via complete.
 func (this *stateBlockStatement) step() state {
-	if this.n < len(this.body) {
+	if this.pending.typ == completionNormal && this.n < len(this.body) {
 		s := newState(this, this.scope, (this.body)[this.n])
 		this.n++
 		return s
 	}
-	return this.parent
+	if this.outer != nil {
+		this.scope = this.outer
+	}
+	return this.complete(this.pending)
+}
+
+func (this *stateBlockStatement) acceptCompletion(c completion) {
+	this.pending = c
+}
+
+/********************************************************************/
+
+// stateBreakStatement has no step of its own to perform: it just
+// turns itself directly into a completionBreak completion, to be
+// consumed by the nearest enclosing stateLabeledStatement whose label
+// matches (if label is non-empty) or, for an unlabeled break, by a
+// loop or switch state - see flow.Analyze, which rejects any program
+// where no such state would exist at runtime.
+type stateBreakStatement struct {
+	stateCommon
+	label string
+}
+
+func (this *stateBreakStatement) init(node *ast.BreakStatement) {
+	if node.Label != nil {
+		this.label = node.Label.Name
+	}
+}
+
+func (this *stateBreakStatement) step() state {
+	return this.complete(completion{typ: completionBreak, label: this.label})
 }
 
 /********************************************************************/
 
 type stateConditionalExpression struct {
 	stateCommon
+	start      int
 	test       ast.Expression
 	consequent ast.Expression
 	alternate  ast.Expression
@@ -479,6 +968,7 @@ type stateConditionalExpression struct {
 }
 
 func (this *stateConditionalExpression) init(node *ast.ConditionalExpression) {
+	this.start = node.Start()
 	this.test = node.Test
 	this.consequent = node.Consequent
 	this.alternate = node.Alternate
@@ -488,9 +978,13 @@ func (this *stateConditionalExpression) step() state {
 	if !this.haveResult {
 		return newState(this, this.scope, ast.Node(this.test.E))
 	}
+	// Record which arm was taken before evaluating it, rather than
+	// instrumenting both sides.
 	if this.result {
+		this.scope.interpreter.Coverage.HitBranch(this.start, 0, 2)
 		return newState(this.parent, this.scope, this.consequent.E)
 	} else {
+		this.scope.interpreter.Coverage.HitBranch(this.start, 1, 2)
 		return newState(this.parent, this.scope, this.alternate.E)
 	}
 }
@@ -505,6 +999,27 @@ func (this *stateConditionalExpression) acceptValue(v object.Value) {
 
 /********************************************************************/
 
+// stateContinueStatement is to a loop what stateBreakStatement is to a
+// loop or switch: it just produces a completionContinue completion,
+// to be consumed by the loop state (not yet implemented) that it
+// targets.
+type stateContinueStatement struct {
+	stateCommon
+	label string
+}
+
+func (this *stateContinueStatement) init(node *ast.ContinueStatement) {
+	if node.Label != nil {
+		this.label = node.Label.Name
+	}
+}
+
+func (this *stateContinueStatement) step() state {
+	return this.complete(completion{typ: completionContinue, label: this.label})
+}
+
+/********************************************************************/
+
 type stateEmptyStatement struct {
 	stateCommon
 }
@@ -513,7 +1028,7 @@ func (this *stateEmptyStatement) init(node *ast.EmptyStatement) {
 }
 
 func (this *stateEmptyStatement) step() state {
-	return this.parent
+	return this.completeNormal()
 }
 
 /********************************************************************/
@@ -534,7 +1049,7 @@ func (this *stateExpressionStatement) step() state {
 		this.done = true
 		return newState(this, this.scope, ast.Node(this.expr.E))
 	} else {
-		return this.parent
+		return this.completeNormal()
 	}
 }
 
@@ -561,7 +1076,7 @@ func (this *stateFunctionDeclaration) init(node *ast.FunctionDeclaration) {
 }
 
 func (this *stateFunctionDeclaration) step() state {
-	return this.parent
+	return this.completeNormal()
 }
 
 /********************************************************************/
@@ -591,6 +1106,7 @@ func (this *stateIdentifier) step() state {
 // of course).
 type stateIfStatement struct {
 	stateCommon
+	start      int
 	test       ast.Expression
 	consequent ast.Statement
 	alternate  ast.Statement
@@ -599,6 +1115,7 @@ type stateIfStatement struct {
 }
 
 func (this *stateIfStatement) init(node *ast.IfStatement) {
+	this.start = node.Start()
 	this.test = node.Test
 	this.consequent = node.Consequent
 	this.alternate = node.Alternate
@@ -608,9 +1125,13 @@ func (this *stateIfStatement) step() state {
 	if !this.haveResult {
 		return newState(this, this.scope, ast.Node(this.test.E))
 	}
+	// Record which arm was taken before evaluating it, rather than
+	// instrumenting both sides.
 	if this.result {
+		this.scope.interpreter.Coverage.HitBranch(this.start, 0, 2)
 		return newState(this.parent, this.scope, this.consequent.S)
 	} else {
+		this.scope.interpreter.Coverage.HitBranch(this.start, 1, 2)
 		return newState(this.parent, this.scope, this.alternate.S)
 	}
 }
@@ -625,6 +1146,45 @@ func (this *stateIfStatement) acceptValue(v object.Value) {
 
 /********************************************************************/
 
+// stateLabeledStatement runs its single labeled body statement, then
+// inspects how that statement completed: a break naming this
+// statement's own label is consumed here (the labeled statement as a
+// whole then completes normally); anything else propagates unchanged.
+// (An unlabeled or differently-labeled continue can't reach here in a
+// well-formed program: flow.Analyze rejects any continue that doesn't
+// target an enclosing loop, and this type of label never is one,
+// since we don't yet have loop states.)
+type stateLabeledStatement struct {
+	stateCommon
+	label   string
+	body    ast.Statement
+	started bool
+	pending completion
+}
+
+func (this *stateLabeledStatement) init(node *ast.LabeledStatement) {
+	this.label = node.Label.Name
+	this.body = node.Body
+}
+
+func (this *stateLabeledStatement) step() state {
+	if !this.started {
+		this.started = true
+		return newState(this, this.scope, this.body.S)
+	}
+	c := this.pending
+	if c.typ == completionBreak && c.label == this.label {
+		c = completion{typ: completionNormal}
+	}
+	return this.complete(c)
+}
+
+func (this *stateLabeledStatement) acceptCompletion(c completion) {
+	this.pending = c
+}
+
+/********************************************************************/
+
 type stateLiteral struct {
 	stateCommon
 	value object.Value
@@ -686,12 +1246,184 @@ func (this *stateObjectExpression) acceptValue(v object.Value) {
 	case *ast.Identifier:
 		key = k.Name
 	}
-	this.obj.SetProperty(key, v)
+	this.obj.SetProperty(object.String(key), v)
 	this.n++
 }
 
 /********************************************************************/
 
+// stateReturnStatement evaluates its (optional) argument, then
+// completes with a completionReturn carrying that value (or
+// object.Undefined{}, for a bare "return;"), to be consumed by the
+// function call (not yet implemented) that it returns from.
+type stateReturnStatement struct {
+	stateCommon
+	arg   ast.Expression
+	value object.Value
+}
+
+func (this *stateReturnStatement) init(node *ast.ReturnStatement) {
+	this.arg = node.Argument
+	if this.arg.E == nil {
+		this.value = object.Undefined{}
+	}
+}
+
+func (this *stateReturnStatement) step() state {
+	if this.value == nil {
+		return newState(this, this.scope, ast.Node(this.arg.E))
+	}
+	return this.complete(completion{typ: completionReturn, value: this.value})
+}
+
+func (this *stateReturnStatement) acceptValue(v object.Value) {
+	this.value = v
+}
+
+/********************************************************************/
+
+// stateThrowStatement evaluates its argument, then completes with a
+// completionThrow carrying that value, to be consumed by the nearest
+// enclosing stateTryStatement with a handler, or - if there is none -
+// by the Interpreter itself; see Threw.
+type stateThrowStatement struct {
+	stateCommon
+	arg   ast.Expression
+	value object.Value
+}
+
+func (this *stateThrowStatement) init(node *ast.ThrowStatement) {
+	this.arg = node.Argument
+}
+
+func (this *stateThrowStatement) step() state {
+	if this.value == nil {
+		return newState(this, this.scope, ast.Node(this.arg.E))
+	}
+	return this.complete(completion{typ: completionThrow, value: this.value})
+}
+
+func (this *stateThrowStatement) acceptValue(v object.Value) {
+	this.value = v
+}
+
+/********************************************************************/
+
+// tryPhase identifies which part of a try statement
+// stateTryStatement is currently executing (or has just finished).
+type tryPhase int
+
+const (
+	tryBlock tryPhase = iota
+	tryHandler
+	tryFinalizer
+	tryDone
+)
+
+// stateTryStatement runs the try block, then - if it threw, and there
+// is a handler - the catch block, then - unconditionally, if present -
+// the finally block, implementing the full set of ECMAScript
+// try/catch/finally interactions: the finally block always runs, and
+// if it completes abruptly, that completion - not the try/catch's
+// own - is the one that propagates; otherwise the try/catch's
+// completion (whatever it was, including completionNormal) does.
+type stateTryStatement struct {
+	stateCommon
+	block     *ast.BlockStatement
+	handler   *ast.CatchClause
+	finalizer *ast.BlockStatement
+	phase     tryPhase
+	pending   completion // outcome of the block most recently run
+	saved     completion // try/catch's completion, pending the finally block
+}
+
+func (this *stateTryStatement) init(node *ast.TryStatement) {
+	this.block = node.Block
+	this.handler = node.Handler
+	this.finalizer = node.Finalizer
+}
+
+func (this *stateTryStatement) step() state {
+	switch this.phase {
+	case tryBlock:
+		this.phase = tryHandler
+		return newState(this, this.scope, this.block)
+	case tryHandler:
+		this.phase = tryFinalizer
+		if this.pending.typ == completionThrow && this.handler != nil {
+			cc := newScope(this.scope, this.scope.interpreter)
+			cc.declare(this.handler.Param.Name, bindingLet)
+			cc.initVar(this.handler.Param.Name, this.pending.value)
+			this.pending = completion{typ: completionNormal}
+			return newState(this, cc, this.handler.Body)
+		}
+		fallthrough
+	case tryFinalizer:
+		this.phase = tryDone
+		if this.finalizer != nil {
+			this.saved = this.pending
+			this.pending = completion{typ: completionNormal}
+			return newState(this, this.scope, this.finalizer)
+		}
+		return this.complete(this.pending)
+	default: // tryDone: the finally block (if any) has just finished.
+		c := this.pending
+		if c.typ == completionNormal {
+			c = this.saved
+		}
+		return this.complete(c)
+	}
+}
+
+func (this *stateTryStatement) acceptCompletion(c completion) {
+	this.pending = c
+}
+
+/********************************************************************/
+
+// stateUpdateExpression implements ++/--, prefix and postfix: it
+// fetches the current value of its lvalue argument, computes the
+// incremented or decremented value, writes that back, and returns to
+// its parent whichever of the two values (old, for postfix; new, for
+// prefix) the expression itself evaluates to.
+type stateUpdateExpression struct {
+	stateCommon
+	op     string
+	prefix bool
+	arg    lvalue
+	old    object.Value
+}
+
+func (this *stateUpdateExpression) init(node *ast.UpdateExpression) {
+	this.op = node.Operator
+	this.prefix = node.Prefix
+	this.arg.init(this.scope, node.Argument)
+}
+
+func (this *stateUpdateExpression) step() state {
+	if !this.arg.ready {
+		return this.arg.next(this)
+	}
+	if this.old == nil {
+		this.old = this.arg.get()
+	}
+	delta := object.Number(1)
+	if this.op == "--" {
+		delta = -1
+	}
+	value := object.Number(this.old.(object.Number) + delta)
+	this.arg.set(value)
+
+	result := object.Value(this.old)
+	if this.prefix {
+		result = value
+	}
+	this.parent.(valueAcceptor).acceptValue(result)
+	return this.parent
+}
+
+/********************************************************************/
+
 type stateVariableDeclaration struct {
 	stateCommon
 	decls []*ast.VariableDeclarator
@@ -699,21 +1431,34 @@ type stateVariableDeclaration struct {
 
 func (this *stateVariableDeclaration) init(node *ast.VariableDeclaration) {
 	this.decls = node.Declarations
-	if node.Kind != "var" {
-		panic(fmt.Errorf("Unknown VariableDeclaration kind '%v'", node.Kind))
+	switch node.Kind {
+	case "var", "let", "const":
+		// Nothing more to do here: scope.populate has already hoisted
+		// (for var) or declared (for let/const) a binding, of the
+		// appropriate kind, for every declarator in this declaration,
+		// before any state began stepping.  All that remains is to
+		// evaluate whichever declarators have initializers, which is
+		// what stateVariableDeclarator does.
+	default:
+		panic(fmt.Errorf("Unknown VariableDeclaration kind %q", node.Kind))
 	}
 }
 
 func (this *stateVariableDeclaration) step() state {
 	// Create a stateVariableDeclarator for every VariableDeclarator
 	// that has an Init value, chaining them together so they will
-	// execute in left-to-right order.
+	// execute in left-to-right order; the last one in the chain (or,
+	// if none had an initialiser, this statement itself) is what
+	// reports this declaration's completion.
 	var p = this.parent
 	for i := len(this.decls) - 1; i >= 0; i-- {
 		if this.decls[i].Init.E != nil {
 			p = newState(p, this.scope, this.decls[i])
 		}
 	}
+	if p == this.parent {
+		return this.completeNormal()
+	}
 	return p
 }
 
@@ -740,8 +1485,8 @@ func (this *stateVariableDeclarator) step() state {
 	if this.value == nil {
 		return newState(this, this.scope, ast.Node(this.expr.E))
 	} else {
-		this.scope.setVar(this.name, this.value)
-		return this.parent
+		this.scope.initVar(this.name, this.value)
+		return this.completeNormal()
 	}
 }
 
@@ -757,29 +1502,53 @@ func (this *stateVariableDeclarator) acceptValue(v object.Value) {
 //
 // Usage:
 //
-//  struct stateFoo {
-//      stateCommon
-//      lv lvalue
-//      ...
-//  }
+//	struct stateFoo {
+//	    stateCommon
+//	    lv lvalue
+//	    ...
+//	}
 //
-//  func (this *stateFoo) init(node *ast.Foo) {
-//      this.lv.init(this.scope, node.left)
-//      ...
-//  }
+//	func (this *stateFoo) init(node *ast.Foo) {
+//	    this.lv.init(this.scope, node.left)
+//	    ...
+//	}
 //
-//  func (this *stateFoo) step() state {
-//      if(!this.lv.ready) {
-//          return this.lv.next(this)
-//      }
-//      ...
-//      lv.set(lv.get() + 1) // or whatever
-//      ...
-//  }
+//	func (this *stateFoo) step() state {
+//	    if(!this.lv.ready) {
+//	        return this.lv.next(this)
+//	    }
+//	    ...
+//	    lv.set(lv.get() + 1) // or whatever
+//	    ...
+//	}
 //
+// lvalueKind distinguishes the two forms of lvalue this interpreter
+// supports: a bare identifier, resolved through the scope chain, and
+// a MemberExpression, resolved as a property of an object.
+type lvalueKind int
+
+const (
+	identName lvalueKind = iota
+	objectProperty
+)
+
 type lvalue struct {
 	stateCommon
-	name  string
+	kind lvalueKind
+
+	// identName
+	name string
+
+	// objectProperty
+	objExpr  ast.Expression // the MemberExpression's object subexpression
+	keyExpr  ast.Expression // the property subexpression, if computed
+	keyName  string         // the property name, if not computed
+	computed bool
+	obj      object.Value
+	haveObj  bool
+	key      object.Value // the evaluated property key, if computed; may be a Symbol
+	haveKey  bool
+
 	ready bool
 }
 
@@ -788,21 +1557,45 @@ func (this *lvalue) init(scope *scope, expr ast.Expression) {
 
 	switch e := expr.E.(type) {
 	case *ast.Identifier:
+		this.kind = identName
 		this.name = e.Name
 		this.ready = true
 	case *ast.MemberExpression:
-		panic("not implemented")
+		this.kind = objectProperty
+		this.objExpr = e.Object
+		this.computed = e.Computed
+		if e.Computed {
+			this.keyExpr = e.Property
+		} else {
+			this.keyName = e.Property.E.(*ast.Identifier).Name
+		}
 	default:
 		panic(fmt.Errorf("%T is not an lvalue", expr.E))
 	}
 }
 
+// next kicks off evaluation of this lvalue's subexpressions (the
+// object, and - if computed - the property key, of a MemberExpression)
+// on behalf of parent, which is given back once they are all known;
+// it is never called for an identName lvalue, since that is ready as
+// soon as init returns.
 func (this *lvalue) next(parent state) state {
 	if this.ready {
 		// Nothing to do.  Why was this called?
 		panic("lvalue already ready")
 	}
-	panic("not implemented")
+	this.parent = parent
+	return newState(this, this.scope, ast.Node(this.objExpr.E))
+}
+
+// propertyKey returns the already-evaluated (if computed) or
+// statically-known (if not) property key of an objectProperty
+// lvalue.  A computed key may be a Symbol as well as a String.
+func (this *lvalue) propertyKey() object.Value {
+	if this.computed {
+		return this.key
+	}
+	return object.String(this.keyName)
 }
 
 // get returns the current value of the variable or property denoted
@@ -811,7 +1604,18 @@ func (this *lvalue) get() object.Value {
 	if !this.ready {
 		panic("lvalue not ready")
 	}
-	return this.scope.getVar(this.name)
+	switch this.kind {
+	case identName:
+		return this.scope.getVar(this.name)
+	case objectProperty:
+		v, err := this.obj.GetProperty(this.propertyKey())
+		if err != nil {
+			panic(err)
+		}
+		return v
+	default:
+		panic(fmt.Errorf("unknown lvalueKind %d", this.kind))
+	}
 }
 
 // set updates the variable or property denoted
@@ -820,13 +1624,46 @@ func (this *lvalue) set(value object.Value) {
 	if !this.ready {
 		panic("lvalue not ready")
 	}
-	this.scope.setVar(this.name, value)
+	switch this.kind {
+	case identName:
+		this.scope.setVar(this.name, value)
+	case objectProperty:
+		if err := this.obj.SetProperty(this.propertyKey(), value); err != nil {
+			panic(err)
+		}
+	default:
+		panic(fmt.Errorf("unknown lvalueKind %d", this.kind))
+	}
 }
 
 func (this *lvalue) step() state {
-	panic("not implemented")
+	if this.kind != objectProperty {
+		panic("lvalue.step called on an identName lvalue")
+	}
+	if !this.haveObj {
+		panic("lvalue.step called before its object was evaluated")
+	}
+	if this.computed && !this.haveKey {
+		return newState(this, this.scope, ast.Node(this.keyExpr.E))
+	}
+	this.ready = true
+	return this.parent
 }
 
 func (this *lvalue) acceptValue(v object.Value) {
-	panic("not implemented")
+	if !this.haveObj {
+		this.obj = v
+		this.haveObj = true
+		return
+	}
+	if this.computed && !this.haveKey {
+		key, err := object.ToPropertyKey(v)
+		if err != nil {
+			panic(err)
+		}
+		this.key = key
+		this.haveKey = true
+		return
+	}
+	panic("lvalue got an unexpected extra value")
 }
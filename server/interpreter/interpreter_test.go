@@ -17,6 +17,7 @@
 package interpreter
 
 import (
+	"CodeCity/server/interpreter/flow"
 	"CodeCity/server/interpreter/object"
 	// "fmt"
 	"testing"
@@ -40,6 +41,9 @@ func TestInterpreterSimple(t *testing.T) {
 		{"var o={}; o.foo=45; o.foo", propertyAssignment, object.Number(45)},
 		{"var x=45; x++; x++", postincrement, object.Number(46)},
 		{"var x=45; ++x; ++x", preincrement, object.Number(47)},
+		{"return 42", returnStatement, object.Number(42)},
+		{"var o={}; o[\"foo\"]=45; o[\"foo\"]", computedPropertyAssignment, object.Number(45)},
+		{"var x=5; x+=3; x", compoundAssignment, object.Number(8)},
 	}
 
 	for _, c := range tests {
@@ -52,6 +56,126 @@ func TestInterpreterSimple(t *testing.T) {
 	}
 }
 
+func TestCoverageStatementHits(t *testing.T) {
+	i := New(simpleFourFunction)
+	i.Coverage.Enable()
+	i.Run()
+
+	// simpleFourFunction is a single ExpressionStatement starting at
+	// offset 0.
+	if hits := i.Coverage.StatementHits(0); hits != 1 {
+		t.Errorf("Coverage.StatementHits(0) == %d (expected 1)", hits)
+	}
+}
+
+func TestCoverageDisabledByDefault(t *testing.T) {
+	i := New(simpleFourFunction)
+	i.Run()
+	if hits := i.Coverage.StatementHits(0); hits != 0 {
+		t.Errorf("Coverage.StatementHits(0) == %d (expected 0; "+
+			"coverage should be disabled by default)", hits)
+	}
+}
+
+func TestCoverageBranchHits(t *testing.T) {
+	i := New(ifTrue)
+	i.Coverage.Enable()
+	i.Run()
+	// The IfStatement in ifTrue starts at offset 0; its consequent
+	// (arm 0) is taken and its alternate (arm 1) is not.
+	if branches := i.Coverage.BranchHits(0); branches == nil ||
+		branches[0] != 1 || branches[1] != 0 {
+		t.Errorf("ifTrue: Coverage.BranchHits(0) == %v "+
+			"(expected [1 0])", branches)
+	}
+
+	i = New(ifFalse)
+	i.Coverage.Enable()
+	i.Run()
+	if branches := i.Coverage.BranchHits(0); branches == nil ||
+		branches[0] != 0 || branches[1] != 1 {
+		t.Errorf("ifFalse: Coverage.BranchHits(0) == %v "+
+			"(expected [0 1]; the untaken consequent should have "+
+			"zero hits)", branches)
+	}
+}
+
+func TestFlowUnreachableStatement(t *testing.T) {
+	i := New(unreachableAfterReturn)
+	if len(i.Diagnostics) != 1 {
+		t.Fatalf("New(unreachableAfterReturn).Diagnostics == %v "+
+			"(expected exactly one diagnostic)", i.Diagnostics)
+	}
+	d := i.Diagnostics[0]
+	if d.Severity != flow.Warning || d.Start != 10 {
+		t.Errorf("New(unreachableAfterReturn).Diagnostics[0] == %+v "+
+			"(expected a Warning at offset 10, the \"2;\" after the return)", d)
+	}
+}
+
+func TestFlowUndefinedLabel(t *testing.T) {
+	i := New(undefinedLabelBreak)
+	if len(i.Diagnostics) != 1 || i.Diagnostics[0].Severity != flow.Fatal {
+		t.Fatalf("New(undefinedLabelBreak).Diagnostics == %v "+
+			"(expected exactly one Fatal diagnostic)", i.Diagnostics)
+	}
+	// A Fatal diagnostic means New refuses to run the program at all.
+	if i.Step() {
+		t.Errorf("Step() on a program with a Fatal diagnostic took a step")
+	}
+}
+
+func TestFlowFunctionFallsOffEnd(t *testing.T) {
+	i := New(functionFallsOffEnd)
+	var found bool
+	for _, d := range i.Diagnostics {
+		if d.Severity == flow.Warning {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("New(functionFallsOffEnd).Diagnostics == %v "+
+			"(expected a Warning about falling off the end)", i.Diagnostics)
+	}
+}
+
+func TestInterpreterLabeledBreak(t *testing.T) {
+	i := New(labeledBreak)
+	i.Run()
+	// The "99;" following the break is never reached, so the labeled
+	// block's last effect on Value is the "1;" that ran before it; the
+	// break is consumed by the label, so the program completes normally.
+	if v := i.Value(); v != object.Number(1) {
+		t.Errorf("labeledBreak: Value() == %v (%T) (expected 1)", v, v)
+	}
+}
+
+func TestInterpreterUncaughtThrow(t *testing.T) {
+	i := New(uncaughtThrow)
+	i.Run()
+	if !i.Threw {
+		t.Errorf("uncaughtThrow: Threw == false (expected true)")
+	}
+	if v := i.Value(); v != object.String("oops") {
+		t.Errorf("uncaughtThrow: Value() == %v (%T) (expected \"oops\")", v, v)
+	}
+}
+
+func TestInterpreterTryFinallyRestoresBreak(t *testing.T) {
+	i := New(tryFinallyRestoresBreak)
+	i.Run()
+	// The try's break (caught by neither its catch, which only handles
+	// throw, nor consumed until it reaches the label) must survive the
+	// finally block running, so the "2;" after the try is skipped; the
+	// label then consumes the break and lets "3;" run.
+	if i.Threw {
+		t.Errorf("tryFinallyRestoresBreak: Threw == true (expected false)")
+	}
+	if v := i.Value(); v != object.Number(3) {
+		t.Errorf("tryFinallyRestoresBreak: Value() == %v (%T) (expected 3)", v, v)
+	}
+}
+
 func TestInterpreterObjectExpression(t *testing.T) {
 	i := New(objectExpression)
 	i.Run()
@@ -64,16 +188,63 @@ func TestInterpreterObjectExpression(t *testing.T) {
 		t.Errorf("{foo: \"bar\", answer: 42} had %d properties "+
 			"(expected 2)", c)
 	}
-	if foo, _ := v.GetProperty("foo"); foo != object.String("bar") {
+	if foo, _ := v.GetProperty(object.String("foo")); foo != object.String("bar") {
 		t.Errorf("{foo: \"bar\", answer: 42}'s foo == %v (%T) "+
 			"(expected \"bar\")", foo, foo)
 	}
-	if answer, _ := v.GetProperty("answer"); answer != object.Number(42) {
+	if answer, _ := v.GetProperty(object.String("answer")); answer != object.Number(42) {
 		t.Errorf("{foo: \"bar\", answer: 42}'s answer == %v (%T) "+
 			"(expected 42)", answer, answer)
 	}
 }
 
+func TestInterruptHaltsRun(t *testing.T) {
+	i := New(simpleFourFunction)
+	i.Interrupt = make(chan func(), 1)
+	i.Interrupt <- func() { panic("budget exceeded") }
+
+	interrupted, value := i.Run()
+	if !interrupted {
+		t.Fatalf("Run() reported interrupted == false (expected true)")
+	}
+	if value != "budget exceeded" {
+		t.Errorf("Run() returned value %v (expected \"budget exceeded\")", value)
+	}
+}
+
+func TestRunDoesNotMaskInternalPanic(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Run() recovered a panic not raised by an " +
+				"Interrupt function (expected it to propagate)")
+		}
+	}()
+	i := New(simpleFourFunction)
+	i.Interrupt = make(chan func(), 1)
+	// A step that panics on its own account (not via the function
+	// sent on Interrupt) should not be mistaken for an interruption.
+	i.state = panicState{}
+	i.Run()
+}
+
+type panicState struct{}
+
+func (panicState) step() state {
+	panic("not an interruption")
+}
+
+func TestNoInterruptRunsToCompletion(t *testing.T) {
+	i := New(simpleFourFunction)
+	interrupted, _ := i.Run()
+	if interrupted {
+		t.Errorf("Run() reported interrupted == true for a program "+
+			"with no Interrupt channel set (value %v)", i.Value())
+	}
+	if v := i.Value(); v != object.Number(42) {
+		t.Errorf("Value() == %v (%T) (expected 42)", v, v)
+	}
+}
+
 const onePlusOne = `{"type":"Program","start":0,"end":5,"body":[{"type":"ExpressionStatement","start":0,"end":5,"expression":{"type":"BinaryExpression","start":0,"end":5,"left":{"type":"Literal","start":0,"end":1,"value":1,"raw":"1"},"operator":"+","right":{"type":"Literal","start":4,"end":5,"value":1,"raw":"1"}}}]}`
 
 const twoPlusTwo = `{"type":"Program","start":0,"end":5,"body":[{"type":"ExpressionStatement","start":0,"end":5,"expression":{"type":"BinaryExpression","start":0,"end":5,"left":{"type":"Literal","start":0,"end":1,"value":2,"raw":"2"},"operator":"+","right":{"type":"Literal","start":4,"end":5,"value":2,"raw":"2"}}}]}`
@@ -96,21 +267,25 @@ const condTrue = `{"type":"Program","start":0,"end":18,"body":[{"type":"Expressi
 // false?"then":"else"
 const condFalse = `{"type":"Program","start":0,"end":19,"body":[{"type":"ExpressionStatement","start":0,"end":19,"expression":{"type":"ConditionalExpression","start":0,"end":19,"test":{"type":"Literal","start":0,"end":5,"value":false,"raw":"false"},"consequent":{"type":"Literal","start":6,"end":12,"value":"then","raw":"\"then\""},"alternate":{"type":"Literal","start":13,"end":19,"value":"else","raw":"\"else\""}}}]}`
 
-// if(true) {
-//     "then";
-// }
-// else {
-//     "else";
-// }
+//	if(true) {
+//	    "then";
+//	}
+//
+//	else {
+//	    "else";
+//	}
+//
 // => "then"
 const ifTrue = `{"type":"Program","start":0,"end":45,"body":[{"type":"IfStatement","start":0,"end":45,"test":{"type":"Literal","start":3,"end":7,"value":true,"raw":"true"},"consequent":{"type":"BlockStatement","start":9,"end":24,"body":[{"type":"ExpressionStatement","start":15,"end":22,"expression":{"type":"Literal","start":15,"end":21,"value":"then","raw":"\"then\""}}]},"alternate":{"type":"BlockStatement","start":30,"end":45,"body":[{"type":"ExpressionStatement","start":36,"end":43,"expression":{"type":"Literal","start":36,"end":42,"value":"else","raw":"\"else\""}}]}}]}`
 
-// if(false) {
-//     "then";
-// }
-// else {
-//     "else";
-// }
+//	if(false) {
+//	    "then";
+//	}
+//
+//	else {
+//	    "else";
+//	}
+//
 // => "else"
 const ifFalse = `{"type":"Program","start":0,"end":46,"body":[{"type":"IfStatement","start":0,"end":46,"test":{"type":"Literal","start":3,"end":8,"value":false,"raw":"false"},"consequent":{"type":"BlockStatement","start":10,"end":25,"body":[{"type":"ExpressionStatement","start":16,"end":23,"expression":{"type":"Literal","start":16,"end":22,"value":"then","raw":"\"then\""}}]},"alternate":{"type":"BlockStatement","start":31,"end":46,"body":[{"type":"ExpressionStatement","start":37,"end":44,"expression":{"type":"Literal","start":37,"end":43,"value":"else","raw":"\"else\""}}]}}]}`
 
@@ -140,4 +315,55 @@ const preincrement = `{"type":"Program","start":0,"end":21,"body":[{"type":"Vari
 
 // ({foo: "bar", answer: 42})
 // => {foo: "bar", answer: 42}
-const objectExpression = `{"type":"Program","start":0,"end":26,"body":[{"type":"ExpressionStatement","start":0,"end":26,"expression":{"type":"ObjectExpression","start":0,"end":26,"properties":[{"key":{"type":"Identifier","start":2,"end":5,"name":"foo"},"value":{"type":"Literal","start":7,"end":12,"value":"bar","raw":"\"bar\""},"kind":"init"},{"key":{"type":"Identifier","start":14,"end":20,"name":"answer"},"value":{"type":"Literal","start":22,"end":24,"value":42,"raw":"42"},"kind":"init"}]}}]}`
\ No newline at end of file
+const objectExpression = `{"type":"Program","start":0,"end":26,"body":[{"type":"ExpressionStatement","start":0,"end":26,"expression":{"type":"ObjectExpression","start":0,"end":26,"properties":[{"key":{"type":"Identifier","start":2,"end":5,"name":"foo"},"value":{"type":"Literal","start":7,"end":12,"value":"bar","raw":"\"bar\""},"kind":"init"},{"key":{"type":"Identifier","start":14,"end":20,"name":"answer"},"value":{"type":"Literal","start":22,"end":24,"value":42,"raw":"42"},"kind":"init"}]}}]}`
+
+// return 1; 2;
+// The "2;" at offset 10 is unreachable.
+const unreachableAfterReturn = `{"type":"Program","start":0,"end":12,"body":[{"type":"ReturnStatement","start":0,"end":9,"argument":{"type":"Literal","start":7,"end":8,"value":1,"raw":"1"}},{"type":"ExpressionStatement","start":10,"end":12,"expression":{"type":"Literal","start":10,"end":11,"value":2,"raw":"2"}}]}`
+
+// break foo;
+// "foo" never labels anything.
+const undefinedLabelBreak = `{"type":"Program","start":0,"end":10,"body":[{"type":"BreakStatement","start":0,"end":10,"label":{"type":"Identifier","start":6,"end":9,"name":"foo"}}]}`
+
+// function f(x) { if (x) { return 1; } }
+// f can fall off the end without hitting the return.
+const functionFallsOffEnd = `{"type":"Program","start":0,"end":31,"body":[{"type":"FunctionDeclaration","start":0,"end":31,"id":{"type":"Identifier","start":9,"end":10,"name":"f"},"params":[{"type":"Identifier","start":11,"end":12,"name":"x"}],"body":{"type":"BlockStatement","start":13,"end":31,"body":[{"type":"IfStatement","start":14,"end":30,"test":{"type":"Identifier","start":17,"end":18,"name":"x"},"consequent":{"type":"BlockStatement","start":19,"end":30,"body":[{"type":"ReturnStatement","start":20,"end":29,"argument":{"type":"Literal","start":27,"end":28,"value":1,"raw":"1"}}]}}]}}]}`
+
+// return 42;
+const returnStatement = `{"type":"Program","start":0,"end":10,"body":[{"type":"ReturnStatement","start":0,"end":10,"argument":{"type":"Literal","start":7,"end":9,"value":42,"raw":"42"}}]}`
+
+// var o = {};
+// o["foo"] = 45;
+// o["foo"]
+// => 45
+const computedPropertyAssignment = `{"type":"Program","start":0,"end":35,"body":[{"type":"VariableDeclaration","start":0,"end":11,"declarations":[{"type":"VariableDeclarator","start":4,"end":10,"id":{"type":"Identifier","start":4,"end":5,"name":"o"},"init":{"type":"ObjectExpression","start":8,"end":10,"properties":[]}}],"kind":"var"},{"type":"ExpressionStatement","start":12,"end":26,"expression":{"type":"AssignmentExpression","start":12,"end":25,"operator":"=","left":{"type":"MemberExpression","start":12,"end":20,"object":{"type":"Identifier","start":12,"end":13,"name":"o"},"property":{"type":"Literal","start":14,"end":19,"value":"foo","raw":"\"foo\""},"computed":true},"right":{"type":"Literal","start":23,"end":25,"value":45,"raw":"45"}}},{"type":"ExpressionStatement","start":27,"end":35,"expression":{"type":"MemberExpression","start":27,"end":35,"object":{"type":"Identifier","start":27,"end":28,"name":"o"},"property":{"type":"Literal","start":29,"end":34,"value":"foo","raw":"\"foo\""},"computed":true}}]}`
+
+// var x = 5;
+// x += 3;
+// x
+// => 8
+const compoundAssignment = `{"type":"Program","start":0,"end":20,"body":[{"type":"VariableDeclaration","start":0,"end":10,"declarations":[{"type":"VariableDeclarator","start":4,"end":9,"id":{"type":"Identifier","start":4,"end":5,"name":"x"},"init":{"type":"Literal","start":8,"end":9,"value":5,"raw":"5"}}],"kind":"var"},{"type":"ExpressionStatement","start":11,"end":18,"expression":{"type":"AssignmentExpression","start":11,"end":17,"operator":"+=","left":{"type":"Identifier","start":11,"end":12,"name":"x"},"right":{"type":"Literal","start":16,"end":17,"value":3,"raw":"3"}}},{"type":"ExpressionStatement","start":19,"end":20,"expression":{"type":"Identifier","start":19,"end":20,"name":"x"}}]}`
+
+// label: { 1; break label; 99; }
+// => 1 (the "99;" is skipped; the break is consumed by the label)
+const labeledBreak = `{"type":"Program","start":0,"end":30,"body":[{"type":"LabeledStatement","start":0,"end":30,"label":{"type":"Identifier","start":0,"end":5,"name":"label"},"body":{"type":"BlockStatement","start":7,"end":30,"body":[{"type":"ExpressionStatement","start":9,"end":11,"expression":{"type":"Literal","start":9,"end":10,"value":1,"raw":"1"}},{"type":"BreakStatement","start":12,"end":24,"label":{"type":"Identifier","start":18,"end":23,"name":"label"}},{"type":"ExpressionStatement","start":25,"end":28,"expression":{"type":"Literal","start":25,"end":27,"value":99,"raw":"99"}}]}}]}`
+
+// throw "oops";
+const uncaughtThrow = `{"type":"Program","start":0,"end":13,"body":[{"type":"ThrowStatement","start":0,"end":13,"argument":{"type":"Literal","start":6,"end":12,"value":"oops","raw":"\"oops\""}}]}`
+
+//	label: {
+//	    try {
+//	        break label;
+//	    } catch (e) {
+//	        99;
+//	    } finally {
+//	        1;
+//	    }
+//	    2;
+//	}
+//	3;
+//
+// => 3 (the break skips the catch - it only handles throw - and
+// survives the finally running; the label then consumes it, skipping
+// the "2;" after the try but letting the "3;" after the label run)
+const tryFinallyRestoresBreak = `{"type":"Program","start":0,"end":70,"body":[{"type":"LabeledStatement","start":0,"end":67,"label":{"type":"Identifier","start":0,"end":5,"name":"label"},"body":{"type":"BlockStatement","start":7,"end":67,"body":[{"type":"TryStatement","start":9,"end":65,"block":{"type":"BlockStatement","start":13,"end":29,"body":[{"type":"BreakStatement","start":15,"end":27,"label":{"type":"Identifier","start":21,"end":26,"name":"label"}}]},"handler":{"type":"CatchClause","start":30,"end":47,"param":{"type":"Identifier","start":37,"end":38,"name":"e"},"body":{"type":"BlockStatement","start":40,"end":47,"body":[{"type":"ExpressionStatement","start":42,"end":45,"expression":{"type":"Literal","start":42,"end":44,"value":99,"raw":"99"}}]}},"finalizer":{"type":"BlockStatement","start":56,"end":62,"body":[{"type":"ExpressionStatement","start":58,"end":60,"expression":{"type":"Literal","start":58,"end":59,"value":1,"raw":"1"}}]}},{"type":"ExpressionStatement","start":63,"end":65,"expression":{"type":"Literal","start":63,"end":64,"value":2,"raw":"2"}}]}},{"type":"ExpressionStatement","start":68,"end":70,"expression":{"type":"Literal","start":68,"end":69,"value":3,"raw":"3"}}]}`
@@ -0,0 +1,512 @@
+/* Copyright 2017 Google Inc.
+ * https://github.com/NeilFraser/CodeCity
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package interpreter
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"CodeCity/server/interpreter/ast"
+	"CodeCity/server/interpreter/coverage"
+	"CodeCity/server/interpreter/object"
+)
+
+// ModuleLoader resolves module specifiers to URLs and loads the
+// source (or, for import-assertion modules, the raw bytes) found at
+// a URL.  Interpreter embedders provide their own implementation; a
+// nil Interpreter.Loader refuses to load anything, so that CodeCity's
+// persistent world stays sandboxed unless the embedder explicitly
+// supplies a set of modules.
+type ModuleLoader interface {
+	// Resolve turns the specifier written in an import/export
+	// declaration (e.g. "./foo.js") together with the URL of the
+	// module doing the importing into the absolute URL of the module
+	// to be loaded.
+	Resolve(specifier, referrer string) (url string, err error)
+
+	// Load returns the source text found at url, plus any
+	// import-assertion key/value pairs the loader wants to attach
+	// (e.g. a content-type sniffed from a real filesystem or network
+	// loader).  assertions may be nil.
+	Load(url string) (source string, assertions map[string]string, err error)
+}
+
+// MapModuleLoader is a ModuleLoader backed by a fixed, in-memory set
+// of sources, keyed by URL.  Resolve treats every specifier as
+// already being a URL (no relative-path resolution is performed).
+// It is the only ModuleLoader implementation provided by this
+// package; anything that needs to reach outside of an in-memory map
+// (disk, network, the CodeCity database) must supply its own.
+type MapModuleLoader map[string]string
+
+// Resolve implements ModuleLoader.
+func (this MapModuleLoader) Resolve(specifier, referrer string) (string, error) {
+	if _, ok := this[specifier]; !ok {
+		return "", &object.ErrorMsg{
+			Name:    "TypeError",
+			Message: fmt.Sprintf("cannot resolve module %q (imported by %q)", specifier, referrer),
+		}
+	}
+	return specifier, nil
+}
+
+// Load implements ModuleLoader.
+func (this MapModuleLoader) Load(url string) (string, map[string]string, error) {
+	src, ok := this[url]
+	if !ok {
+		return "", nil, &object.ErrorMsg{
+			Name:    "TypeError",
+			Message: fmt.Sprintf("cannot load module %q", url),
+		}
+	}
+	return src, nil, nil
+}
+
+/********************************************************************/
+
+// moduleStatus tracks a moduleRecord through the three phases of ES
+// module evaluation: parse (the record exists but its scope has not
+// been populated), instantiate (bindings exist but have not been
+// evaluated) and evaluate (the module body has been run).
+type moduleStatus int
+
+const (
+	moduleParsed moduleStatus = iota
+	moduleInstantiating
+	moduleInstantiated
+	moduleEvaluating
+	moduleEvaluated
+)
+
+// moduleRecord is the runtime representation of a single loaded
+// module: its own lexical environment (distinct from, and with no
+// access to, the scope of the script that imported it), the mapping
+// from exported name to the local binding name it refers to, and the
+// bookkeeping needed to support cyclic imports.
+type moduleRecord struct {
+	url     string
+	tree    *ast.Program
+	scope   *scope
+	status  moduleStatus
+	exports map[string]string // exported name -> local binding name
+	// reExports holds the bindings contributed by this module's
+	// `export * from "..."` declarations, which live in another
+	// module's scope rather than this one's.  It is kept separate
+	// from exports (rather than the two sharing a single map with an
+	// encoded key) so that a lookup never has to guess which module a
+	// binding name belongs to.
+	reExports map[string]reExportBinding
+	// json holds the decoded value of a module loaded under an
+	// `assert { type: "json" }` import assertion; such a module has
+	// exactly one export ("default") and is never evaluated as
+	// script.
+	json object.Value
+}
+
+// reExportBinding names a binding exported by some other module,
+// re-exported by this one via `export * from "...".
+type reExportBinding struct {
+	mod   *moduleRecord
+	local string
+}
+
+// moduleNamespace is the object returned for `import * as ns`; it is
+// a live view onto mod's exported bindings; reads consult mod.scope
+// afresh every time, so they observe updates made after the
+// namespace object itself was created.
+type moduleNamespace struct {
+	mod *moduleRecord
+}
+
+func (this *moduleNamespace) IsPrimitive() bool         { return false }
+func (this *moduleNamespace) Type() string              { return "object" }
+func (this *moduleNamespace) ToBoolean() object.Boolean { return object.Boolean(true) }
+func (this *moduleNamespace) ToString() object.String {
+	return object.String("[object Module]")
+}
+func (this *moduleNamespace) Parent() object.Value { return nil }
+
+func (this *moduleNamespace) GetProperty(key object.Value) (object.Value, error) {
+	// Module exports are always string-named - ES modules have no
+	// computed or Symbol export names - so a Symbol key can never
+	// match and falls straight through to the "no such export" error.
+	name := string(key.ToString())
+	if this.mod.json != nil && name == "default" {
+		return this.mod.json, nil
+	}
+	if local, ok := this.mod.exports[name]; ok {
+		return this.mod.scope.getVar(local), nil
+	}
+	if rb, ok := this.mod.reExports[name]; ok {
+		return rb.mod.scope.getVar(rb.local), nil
+	}
+	return nil, &object.ErrorMsg{
+		Name:    "SyntaxError",
+		Message: fmt.Sprintf("module %q has no export named %q", this.mod.url, name),
+	}
+}
+
+func (this *moduleNamespace) SetProperty(key object.Value, v object.Value) error {
+	return &object.ErrorMsg{
+		Name:    "TypeError",
+		Message: fmt.Sprintf("Cannot assign to read only property %q of module namespace", key.ToString()),
+	}
+}
+
+/********************************************************************/
+
+// moduleLinker drives instantiation and evaluation of a module and
+// the transitive closure of modules it imports.  It holds the map of
+// already-loaded modules (keyed by URL) so that a module imported
+// from two different places - or from a cycle - is only ever parsed,
+// instantiated and evaluated once.
+type moduleLinker struct {
+	interp  *Interpreter
+	loader  ModuleLoader
+	modules map[string]*moduleRecord
+}
+
+// NewModule parses astJSON (in the same JSON-encoded-ESTree format
+// accepted by New) as an ES module whose own URL is url, resolving
+// and linking any modules it imports via loader, and returns an
+// Interpreter ready to evaluate it.  Unlike New, this can fail: module
+// resolution/instantiation errors are returned rather than panicking,
+// since they routinely result from ordinary embedder mistakes (a
+// missing module) rather than a malformed AST.
+func NewModule(astJSON, url string, loader ModuleLoader) (*Interpreter, error) {
+	tree, err := ast.NewFromJSON(astJSON)
+	if err != nil {
+		return nil, err
+	}
+	program, ok := tree.(*ast.Program)
+	if !ok {
+		return nil, &object.ErrorMsg{Name: "TypeError", Message: "module source is not a Program"}
+	}
+
+	this := new(Interpreter)
+	this.Coverage = coverage.New()
+	this.Loader = loader
+
+	l := &moduleLinker{interp: this, loader: loader, modules: make(map[string]*moduleRecord)}
+	mod, err := l.load(url, program, "<entry>")
+	if err != nil {
+		return nil, err
+	}
+	if err := l.instantiate(mod); err != nil {
+		return nil, err
+	}
+	if mod.json != nil {
+		// A JSON module has no statements to run; its value is
+		// immediately available.
+		this.value = mod.json
+		this.state = nil
+		return this, nil
+	}
+	// Evaluate (run the top-level code of) every module mod imports,
+	// each exactly once, before handing control back to the caller.
+	// mod itself is *not* run here: like an Interpreter created with
+	// New, it is left for the caller to execute via Run or Step.
+	if err := l.evaluateImports(mod); err != nil {
+		return nil, err
+	}
+	mod.status = moduleEvaluated
+	this.state = newState(nil, mod.scope, mod.tree)
+	return this, nil
+}
+
+// load returns the moduleRecord for url, creating and registering one
+// for the already-parsed tree if url has not already been seen.
+func (this *moduleLinker) load(url string, tree *ast.Program, referrer string) (*moduleRecord, error) {
+	if mod, ok := this.modules[url]; ok {
+		return mod, nil
+	}
+	mod := &moduleRecord{
+		url:     url,
+		tree:    tree,
+		exports: make(map[string]string),
+	}
+	// Registering the (still-empty) record before recursing into its
+	// imports is what lets import cycles resolve instead of looping
+	// forever.
+	this.modules[url] = mod
+	return mod, nil
+}
+
+// loadBySpecifier resolves specifier (as imported by referrer) and
+// loads+parses the module found there, honouring assertions (of
+// which the only one currently recognised is `{"type": "json"}`).
+func (this *moduleLinker) loadBySpecifier(specifier, referrer string, assertions map[string]string) (*moduleRecord, error) {
+	if this.loader == nil {
+		return nil, &object.ErrorMsg{
+			Name:    "TypeError",
+			Message: fmt.Sprintf("cannot resolve module %q (imported by %q): no module loader", specifier, referrer),
+		}
+	}
+	url, err := this.loader.Resolve(specifier, referrer)
+	if err != nil {
+		return nil, err
+	}
+	if mod, ok := this.modules[url]; ok {
+		return mod, nil
+	}
+	src, loaderAssertions, err := this.loader.Load(url)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range loaderAssertions {
+		if assertions == nil {
+			assertions = make(map[string]string)
+		}
+		if _, ok := assertions[k]; !ok {
+			assertions[k] = v
+		}
+	}
+
+	if assertions["type"] == "json" {
+		var v interface{}
+		if err := json.Unmarshal([]byte(src), &v); err != nil {
+			return nil, &object.ErrorMsg{
+				Name:    "TypeError",
+				Message: fmt.Sprintf("module %q: invalid JSON: %v", url, err),
+			}
+		}
+		mod := &moduleRecord{
+			url:     url,
+			exports: map[string]string{"default": "default"},
+			json:    jsonToValue(v),
+			status:  moduleEvaluated,
+		}
+		this.modules[url] = mod
+		return mod, nil
+	}
+	if assertions["type"] != "" && assertions["type"] != "javascript" {
+		return nil, &object.ErrorMsg{
+			Name:    "TypeError",
+			Message: fmt.Sprintf("module %q: unsupported import assertion type %q", url, assertions["type"]),
+		}
+	}
+
+	tree, err := ast.NewFromJSON(src)
+	if err != nil {
+		return nil, err
+	}
+	program, ok := tree.(*ast.Program)
+	if !ok {
+		return nil, &object.ErrorMsg{Name: "TypeError", Message: fmt.Sprintf("module %q is not a Program", url)}
+	}
+	return this.load(url, program, referrer)
+}
+
+// jsonToValue converts the tree produced by encoding/json.Unmarshal
+// (into an interface{}) into the equivalent object.Value tree, for
+// use as the default export of a JSON module.
+func jsonToValue(v interface{}) object.Value {
+	switch v := v.(type) {
+	case nil:
+		return object.Null{}
+	case bool:
+		return object.Boolean(v)
+	case float64:
+		return object.Number(v)
+	case string:
+		return object.String(v)
+	case []interface{}:
+		obj := object.New(nil, object.ObjectProto)
+		for i, e := range v {
+			obj.SetProperty(object.Number(i).ToString(), jsonToValue(e))
+		}
+		return obj
+	case map[string]interface{}:
+		obj := object.New(nil, object.ObjectProto)
+		for k, e := range v {
+			obj.SetProperty(object.String(k), jsonToValue(e))
+		}
+		return obj
+	default:
+		panic(fmt.Errorf("unexpected JSON value type %T", v))
+	}
+}
+
+// instantiate performs the "instantiate bindings" phase: it populates
+// mod's own scope with its local (var/let/const/function) bindings,
+// recursively instantiates every module it imports, and binds the
+// imported names into mod's scope.  It does not evaluate any module
+// body.  Running instantiate before evaluate (rather than the two
+// being interleaved) is what lets a live binding in a cyclic import
+// see the eventual value instead of whatever happened to be present
+// at import time.
+func (this *moduleLinker) instantiate(mod *moduleRecord) error {
+	if mod.status >= moduleInstantiating {
+		return nil // already in progress or done; cycle.
+	}
+	mod.status = moduleInstantiating
+	mod.scope = newScope(nil, this.interp)
+	mod.scope.populate(mod.tree)
+
+	for _, s := range mod.tree.Body {
+		switch d := s.(type) {
+		case *ast.ImportDeclaration:
+			assertions := assertionsOf(d)
+			imported, err := this.loadBySpecifier(specifierOf(d.Source), mod.url, assertions)
+			if err != nil {
+				return err
+			}
+			if err := this.instantiate(imported); err != nil {
+				return err
+			}
+			for _, spec := range d.Specifiers {
+				switch sp := spec.(type) {
+				case *ast.ImportDefaultSpecifier:
+					mod.scope.vars[sp.Local.Name] = &binding{importedBinding(imported, "default"), bindingConst}
+				case *ast.ImportNamespaceSpecifier:
+					mod.scope.vars[sp.Local.Name] = &binding{&moduleNamespace{imported}, bindingConst}
+				case *ast.ImportSpecifier:
+					mod.scope.vars[sp.Local.Name] = &binding{importedBinding(imported, sp.Imported.Name), bindingConst}
+				}
+			}
+		case *ast.ExportNamedDeclaration:
+			// d.Declaration, if any, was already added to mod.scope
+			// by the populate() call above, which recurses into
+			// Program's body including export declarations.
+			for _, spec := range d.Specifiers {
+				mod.exports[spec.Exported.Name] = spec.Local.Name
+			}
+		case *ast.ExportDefaultDeclaration:
+			mod.exports["default"] = "*default*"
+		case *ast.ExportAllDeclaration:
+			reExported, err := this.loadBySpecifier(specifierOf(d.Source), mod.url, nil)
+			if err != nil {
+				return err
+			}
+			if err := this.instantiate(reExported); err != nil {
+				return err
+			}
+			if mod.reExports == nil {
+				mod.reExports = make(map[string]reExportBinding)
+			}
+			for name, local := range reExported.exports {
+				if name != "default" {
+					mod.reExports[name] = reExportBinding{reExported, local}
+				}
+			}
+			for name, rb := range reExported.reExports {
+				mod.reExports[name] = rb
+			}
+		}
+	}
+	mod.status = moduleInstantiated
+	return nil
+}
+
+// importedBinding returns the (possibly-indirect) value currently
+// bound to the named export of an already-instantiated module, at
+// the time of the call.  Our scope implementation does not yet
+// support true binding cells (see the scope-chain rework tracked
+// elsewhere), so this is only a snapshot, taken during instantiate
+// before any module body has run: it does not track subsequent
+// writes to the binding, which a spec-compliant live binding would.
+// That makes it wrong for the general case of a cyclic import that
+// reads an imported binding after the exporting module has updated
+// it, but is adequate until binding cells exist.
+func importedBinding(mod *moduleRecord, exported string) object.Value {
+	if local, ok := mod.exports[exported]; ok {
+		if mod.scope == nil {
+			return object.Undefined{}
+		}
+		return mod.scope.getVar(local)
+	}
+	if rb, ok := mod.reExports[exported]; ok {
+		if rb.mod.scope == nil {
+			return object.Undefined{}
+		}
+		return rb.mod.scope.getVar(rb.local)
+	}
+	return object.Undefined{}
+}
+
+// specifierOf extracts the Go string value of the Literal node that
+// ESTree uses to represent an import/export declaration's module
+// specifier (e.g. the "./foo.js" in `import x from "./foo.js"`).
+func specifierOf(source *ast.Literal) string {
+	return string(object.PrimitiveFromRaw(source.Raw).(object.String))
+}
+
+// assertionsOf extracts the { key: value } pairs of an import
+// declaration's `assert { ... }` clause.
+func assertionsOf(d *ast.ImportDeclaration) map[string]string {
+	if len(d.Assertions) == 0 {
+		return nil
+	}
+	m := make(map[string]string, len(d.Assertions))
+	for _, a := range d.Assertions {
+		m[a.Key] = a.Value
+	}
+	return m
+}
+
+// evaluateImports runs the top-level code of every module mod
+// imports (directly, or via `export * from`), each exactly once,
+// without running mod's own body.  It is the shared core of both
+// evaluate (used for a module reached via import) and NewModule
+// (which leaves the entry module's own body for the caller to run).
+func (this *moduleLinker) evaluateImports(mod *moduleRecord) error {
+	for _, s := range mod.tree.Body {
+		switch d := s.(type) {
+		case *ast.ImportDeclaration:
+			imported, err := this.loadBySpecifier(specifierOf(d.Source), mod.url, assertionsOf(d))
+			if err != nil {
+				return err
+			}
+			if err := this.evaluate(imported); err != nil {
+				return err
+			}
+		case *ast.ExportAllDeclaration:
+			reExported, err := this.loadBySpecifier(specifierOf(d.Source), mod.url, nil)
+			if err != nil {
+				return err
+			}
+			if err := this.evaluate(reExported); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// evaluate performs the "evaluate" phase for a module reached via
+// import: it runs the statements of everything mod (transitively)
+// imports, then mod's own statements, each exactly once.
+func (this *moduleLinker) evaluate(mod *moduleRecord) error {
+	if mod.status >= moduleEvaluating {
+		return nil // already in progress (cycle) or done.
+	}
+	mod.status = moduleEvaluating
+	if err := this.evaluateImports(mod); err != nil {
+		return err
+	}
+
+	i := &Interpreter{Coverage: this.interp.Coverage, Interrupt: this.interp.Interrupt}
+	i.state = newState(nil, mod.scope, mod.tree)
+	if interrupted, value := i.Run(); interrupted {
+		return &object.ErrorMsg{
+			Name:    "Error",
+			Message: fmt.Sprintf("module %q: evaluation interrupted: %v", mod.url, value),
+		}
+	}
+	mod.status = moduleEvaluated
+	return nil
+}
@@ -0,0 +1,67 @@
+/* Copyright 2017 Google Inc.
+ * https://github.com/NeilFraser/CodeCity
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package interpreter
+
+import (
+	"CodeCity/server/interpreter/object"
+	"testing"
+)
+
+func TestMapModuleLoaderResolve(t *testing.T) {
+	l := MapModuleLoader{"./foo.js": "1;"}
+	if url, err := l.Resolve("./foo.js", "<entry>"); err != nil || url != "./foo.js" {
+		t.Errorf("Resolve(\"./foo.js\", ...) == %q, %v (expected \"./foo.js\", nil)", url, err)
+	}
+	if _, err := l.Resolve("./missing.js", "<entry>"); err == nil {
+		t.Errorf("Resolve(\"./missing.js\", ...) returned nil error (expected a TypeError)")
+	}
+}
+
+func TestMapModuleLoaderLoad(t *testing.T) {
+	l := MapModuleLoader{"./foo.js": "1;"}
+	if src, _, err := l.Load("./foo.js"); err != nil || src != "1;" {
+		t.Errorf("Load(\"./foo.js\") == %q, %v (expected \"1;\", nil)", src, err)
+	}
+	if _, _, err := l.Load("./missing.js"); err == nil {
+		t.Errorf("Load(\"./missing.js\") returned nil error (expected a TypeError)")
+	}
+}
+
+func TestNewModuleNoImports(t *testing.T) {
+	// onePlusOne has no import or export declarations, so it can be
+	// loaded as a module (with an empty loader, since it never
+	// consults it) and should evaluate the same as under New.
+	i, err := NewModule(onePlusOne, "<entry>", MapModuleLoader{})
+	if err != nil {
+		t.Fatalf("NewModule(onePlusOne, ...) returned error: %v", err)
+	}
+	i.Run()
+	if v := i.Value(); v != object.Number(2) {
+		t.Errorf("NewModule(onePlusOne, ...).Value() == %v (%T) "+
+			"(expected 2)", v, v)
+	}
+}
+
+func TestNewModuleResolveError(t *testing.T) {
+	// A module whose loader cannot resolve one of its imports should
+	// report the error rather than panicking.
+	const importsMissing = `{"type":"Program","start":0,"end":24,"body":[{"type":"ImportDeclaration","start":0,"end":24,"specifiers":[],"source":{"type":"Literal","start":17,"end":23,"value":"./x.js","raw":"\"./x.js\""},"assertions":[]}]}`
+	if _, err := NewModule(importsMissing, "<entry>", MapModuleLoader{}); err == nil {
+		t.Errorf("NewModule(importsMissing, ...) returned nil error " +
+			"(expected a TypeError for the unresolvable import)")
+	}
+}
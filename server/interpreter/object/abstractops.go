@@ -0,0 +1,427 @@
+/* Copyright 2017 Google Inc.
+ * https://github.com/NeilFraser/CodeCity
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+)
+
+// This file implements the remaining ES5.1 §9 (Type Conversion) and
+// §11.9/11.8.5 (Equality and Relational Comparison) abstract
+// operations not already provided by ToNumber and ToBigInt in
+// bigint.go.
+
+// ToInteger implements the ES5.1 9.4 ToInteger abstract operation:
+// NaN converts to 0; +Infinity, -Infinity, 0 and -0 are returned
+// unchanged; everything else is truncated towards zero.
+func ToInteger(v Value) (Number, error) {
+	n, err := ToNumber(v)
+	if err != nil {
+		return 0, err
+	}
+	f := float64(n)
+	if math.IsNaN(f) {
+		return Number(0), nil
+	}
+	if math.IsInf(f, 0) || f == 0 {
+		return n, nil
+	}
+	sign := Number(1)
+	if f < 0 {
+		sign = -1
+	}
+	return sign * Number(math.Floor(math.Abs(f))), nil
+}
+
+// ToInt32 implements the ES5.1 9.5 ToInt32 abstract operation:
+// ToInteger reduced modulo 2**32, then reinterpreted as a signed
+// 32-bit integer.
+func ToInt32(v Value) (int32, error) {
+	m, err := toUint32Bits(v)
+	if err != nil {
+		return 0, err
+	}
+	return int32(m), nil
+}
+
+// ToUint32 implements the ES5.1 9.6 ToUint32 abstract operation:
+// ToInteger reduced modulo 2**32.
+func ToUint32(v Value) (uint32, error) {
+	return toUint32Bits(v)
+}
+
+// ToUint16 implements the ES5.1 9.7 ToUint16 abstract operation:
+// ToInteger reduced modulo 2**16.
+func ToUint16(v Value) (uint16, error) {
+	n, err := ToInteger(v)
+	if err != nil {
+		return 0, err
+	}
+	f := float64(n)
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, nil
+	}
+	const twoPow16 = 65536
+	m := math.Mod(f, twoPow16)
+	if m < 0 {
+		m += twoPow16
+	}
+	return uint16(m), nil
+}
+
+// toUint32Bits computes ToInteger(v) modulo 2**32, as an unsigned
+// 32-bit bit pattern; ToInt32 and ToUint32 differ only in how they
+// interpret that pattern.
+func toUint32Bits(v Value) (uint32, error) {
+	n, err := ToInteger(v)
+	if err != nil {
+		return 0, err
+	}
+	f := float64(n)
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, nil
+	}
+	const twoPow32 = 4294967296
+	m := math.Mod(f, twoPow32)
+	if m < 0 {
+		m += twoPow32
+	}
+	return uint32(m), nil
+}
+
+// ToPrimitive implements the ES2015 7.1.1 ToPrimitive abstract
+// operation.  hint should be "number", "string", or "" (meaning
+// "default").  Per spec, a Value that is already primitive (which
+// includes Symbol) is returned unchanged without consulting hint at
+// all - @@toPrimitive, and the valueOf/toString fallback, only come
+// into play for an actual Object.
+//
+// FIXME: the non-primitive branch of the real algorithm - look up
+// @@toPrimitive and call it if present, else try valueOf then
+// toString, calling whichever is found and returning its result if
+// primitive - is not implemented here: calling a method requires
+// invoking back into the interpreter, which this package doesn't have
+// a hook for.  A non-primitive Value (such as an *Object) is rejected
+// with a TypeError.
+func ToPrimitive(v Value, hint string) (Value, error) {
+	if v.IsPrimitive() {
+		return v, nil
+	}
+	return nil, &ErrorMsg{
+		Name: "TypeError",
+		Message: fmt.Sprintf("cannot convert %s to a primitive value: "+
+			"calling valueOf/toString is not yet supported", v.Type()),
+	}
+}
+
+// ToObject implements the ES5.1 9.9 ToObject abstract operation.
+//
+// FIXME: boxing a primitive into a Boolean/Number/String wrapper
+// object (as the spec requires for everything but null and
+// undefined) isn't implemented; only the null/undefined TypeError
+// case, which requires no wrapper object, works today.
+func ToObject(v Value) (Value, error) {
+	switch v.(type) {
+	case Null, Undefined:
+		return nil, &ErrorMsg{
+			Name:    "TypeError",
+			Message: "Cannot convert undefined or null to object",
+		}
+	}
+	if !v.IsPrimitive() {
+		return v, nil
+	}
+	return nil, &ErrorMsg{
+		Name:    "TypeError",
+		Message: fmt.Sprintf("boxing a %s into a wrapper object is not yet supported", v.Type()),
+	}
+}
+
+// ToPropertyKey implements the ES2015 7.1.14 ToPropertyKey abstract
+// operation: v is converted via ToPrimitive with hint "string", and
+// the result returned as-is if it's a Symbol (property keys are
+// either Strings or Symbols - a Symbol must never be stringified into
+// "Symbol(desc)", which would collide with an ordinary string-keyed
+// property of that same description) or else coerced to a String.
+func ToPropertyKey(v Value) (Value, error) {
+	p, err := ToPrimitive(v, "string")
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := p.(Symbol); ok {
+		return p, nil
+	}
+	return p.ToString(), nil
+}
+
+// sameType reports whether a and b are values of the same primitive
+// type, in the sense used by the Strict and Abstract Equality
+// Comparison algorithms.
+func sameType(a, b Value) bool {
+	switch a.(type) {
+	case Undefined:
+		_, ok := b.(Undefined)
+		return ok
+	case Null:
+		_, ok := b.(Null)
+		return ok
+	case Number:
+		_, ok := b.(Number)
+		return ok
+	case String:
+		_, ok := b.(String)
+		return ok
+	case Boolean:
+		_, ok := b.(Boolean)
+		return ok
+	case BigInt:
+		_, ok := b.(BigInt)
+		return ok
+	case Symbol:
+		_, ok := b.(Symbol)
+		return ok
+	default:
+		return false
+	}
+}
+
+func isNullOrUndefined(v Value) bool {
+	switch v.(type) {
+	case Null, Undefined:
+		return true
+	}
+	return false
+}
+
+func booleanToNumber(b Boolean) Number {
+	if b {
+		return Number(1)
+	}
+	return Number(0)
+}
+
+// StrictEquals implements the ES5.1 11.9.6 Strict Equality Comparison
+// algorithm (the === operator).
+func StrictEquals(a, b Value) bool {
+	switch x := a.(type) {
+	case Undefined:
+		_, ok := b.(Undefined)
+		return ok
+	case Null:
+		_, ok := b.(Null)
+		return ok
+	case Number:
+		y, ok := b.(Number)
+		return ok && float64(x) == float64(y)
+	case BigInt:
+		y, ok := b.(BigInt)
+		return ok && x.Int.Cmp(y.Int) == 0
+	case String:
+		y, ok := b.(String)
+		return ok && x == y
+	case Boolean:
+		y, ok := b.(Boolean)
+		return ok && x == y
+	default:
+		// Objects compare by identity.
+		return a == b
+	}
+}
+
+// AbstractEquals implements the ES5.1 11.9.3 Abstract Equality
+// Comparison algorithm (the == operator), extended per ES2020 so that
+// a BigInt compared against a Number or a numeric String compares by
+// mathematical value instead of throwing (7.2.13 IsLooselyEqual).
+func AbstractEquals(a, b Value) (bool, error) {
+	if sameType(a, b) {
+		return StrictEquals(a, b), nil
+	}
+
+	if isNullOrUndefined(a) || isNullOrUndefined(b) {
+		return isNullOrUndefined(a) && isNullOrUndefined(b), nil
+	}
+
+	if n, ok := a.(Number); ok {
+		switch y := b.(type) {
+		case String:
+			return float64(n) == float64(numberFromString(string(y))), nil
+		case Boolean:
+			return AbstractEquals(n, booleanToNumber(y))
+		case BigInt:
+			cmp, nan := compareBigIntAndNumber(y, n)
+			return !nan && cmp == 0, nil
+		}
+	}
+	if n, ok := b.(Number); ok {
+		switch x := a.(type) {
+		case String:
+			return float64(numberFromString(string(x))) == float64(n), nil
+		case Boolean:
+			return AbstractEquals(booleanToNumber(x), n)
+		case BigInt:
+			cmp, nan := compareBigIntAndNumber(x, n)
+			return !nan && cmp == 0, nil
+		}
+	}
+	if s, ok := a.(String); ok {
+		if bi, ok := b.(BigInt); ok {
+			return stringEqualsBigInt(s, bi), nil
+		}
+	}
+	if s, ok := b.(String); ok {
+		if bi, ok := a.(BigInt); ok {
+			return stringEqualsBigInt(s, bi), nil
+		}
+	}
+	if bo, ok := a.(Boolean); ok {
+		return AbstractEquals(booleanToNumber(bo), b)
+	}
+	if bo, ok := b.(Boolean); ok {
+		return AbstractEquals(a, booleanToNumber(bo))
+	}
+	// What's left per spec is one side being an object and the other
+	// a Number, String or BigInt: ToPrimitive the object and recurse.
+	if !a.IsPrimitive() {
+		pa, err := ToPrimitive(a, "")
+		if err != nil {
+			return false, err
+		}
+		return AbstractEquals(pa, b)
+	}
+	if !b.IsPrimitive() {
+		pb, err := ToPrimitive(b, "")
+		if err != nil {
+			return false, err
+		}
+		return AbstractEquals(a, pb)
+	}
+	return false, nil
+}
+
+func stringEqualsBigInt(s String, b BigInt) bool {
+	n, ok := bigIntFromString(strings.TrimSpace(string(s)))
+	if !ok {
+		return false
+	}
+	return n.Cmp(b.Int) == 0
+}
+
+// compareBigIntAndNumber compares b and n by exact mathematical
+// value, as required when a BigInt and a Number meet in an equality
+// or relational comparison (they're never coerced into each other via
+// ToNumber/ToBigInt, which would throw).  cmp is negative, zero or
+// positive as b is less than, equal to, or greater than n; nan
+// reports whether n was NaN, in which case cmp is meaningless.
+func compareBigIntAndNumber(b BigInt, n Number) (cmp int, nan bool) {
+	f := float64(n)
+	if math.IsNaN(f) {
+		return 0, true
+	}
+	if math.IsInf(f, 1) {
+		return -1, false
+	}
+	if math.IsInf(f, -1) {
+		return 1, false
+	}
+	// A precision comfortably beyond both a float64 mantissa and any
+	// BigInt magnitude likely to arise in practice; exactness only
+	// matters relative to f, which has 53 bits of mantissa.
+	const prec = 256
+	bf := new(big.Float).SetPrec(prec).SetInt(b.Int)
+	nf := new(big.Float).SetPrec(prec).SetFloat64(f)
+	return bf.Cmp(nf), false
+}
+
+// AbstractRelational implements the ES5.1 11.8.5 Abstract Relational
+// Comparison algorithm for "a < b".  leftFirst indicates which
+// operand's ToPrimitive conversion the spec evaluates first - true
+// (a first) for < and >=, which pass the operands in source order;
+// false (b first) for > and <=, which pass them swapped, so that the
+// left operand in the source is still converted first.  The result is
+// Boolean, except that per spec it is Undefined{} - not
+// Boolean(false) - when the comparison involves NaN, since callers
+// computing <= or >= need to distinguish "false" from "not true"
+// when negating.
+func AbstractRelational(a, b Value, leftFirst bool) (Value, error) {
+	var pa, pb Value
+	var err error
+	if leftFirst {
+		if pa, err = ToPrimitive(a, "number"); err != nil {
+			return nil, err
+		}
+		if pb, err = ToPrimitive(b, "number"); err != nil {
+			return nil, err
+		}
+	} else {
+		if pb, err = ToPrimitive(b, "number"); err != nil {
+			return nil, err
+		}
+		if pa, err = ToPrimitive(a, "number"); err != nil {
+			return nil, err
+		}
+	}
+
+	if sx, ok := pa.(String); ok {
+		if sy, ok := pb.(String); ok {
+			return Boolean(sx < sy), nil
+		}
+	}
+
+	bx, aIsBigInt := pa.(BigInt)
+	by, bIsBigInt := pb.(BigInt)
+	switch {
+	case aIsBigInt && bIsBigInt:
+		return Boolean(bx.Int.Cmp(by.Int) < 0), nil
+	case aIsBigInt:
+		ny, err := ToNumber(pb)
+		if err != nil {
+			return nil, err
+		}
+		cmp, nan := compareBigIntAndNumber(bx, ny)
+		if nan {
+			return Undefined{}, nil
+		}
+		return Boolean(cmp < 0), nil
+	case bIsBigInt:
+		nx, err := ToNumber(pa)
+		if err != nil {
+			return nil, err
+		}
+		cmp, nan := compareBigIntAndNumber(by, nx)
+		if nan {
+			return Undefined{}, nil
+		}
+		return Boolean(cmp > 0), nil
+	}
+
+	nx, err := ToNumber(pa)
+	if err != nil {
+		return nil, err
+	}
+	ny, err := ToNumber(pb)
+	if err != nil {
+		return nil, err
+	}
+	fx, fy := float64(nx), float64(ny)
+	if math.IsNaN(fx) || math.IsNaN(fy) {
+		return Undefined{}, nil
+	}
+	return Boolean(fx < fy), nil
+}
@@ -0,0 +1,358 @@
+/* Copyright 2017 Google Inc.
+ * https://github.com/NeilFraser/CodeCity
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// BigInt is a primitive Value holding an arbitrary-precision integer,
+// per the ECMAScript 2020 BigInt type.  It embeds *big.Int (rather
+// than, say, copying big.Int's fields into a new named type) so that
+// BigInt values are comparable with == the way the other primitive
+// Values are, at the cost of two BigInts holding equal values not
+// themselves comparing equal unless they share the same underlying
+// *big.Int - see Cmp for value comparison.
+type BigInt struct {
+	*big.Int
+}
+
+// BigIntProto is the prototype of all BigInt values, analogous to
+// NumberProto, StringProto and BooleanProto.
+var BigIntProto = New(nil, ObjectProto)
+
+// IsPrimitive always returns true: a BigInt, like a Number or String,
+// is a primitive value, not an Object.
+func (this BigInt) IsPrimitive() bool {
+	return true
+}
+
+// Type returns "bigint", per the ECMAScript typeof operator.
+func (this BigInt) Type() string {
+	return "bigint"
+}
+
+// ToBoolean returns false if this is zero, true otherwise.
+func (this BigInt) ToBoolean() Boolean {
+	return Boolean(this.Sign() != 0)
+}
+
+// ToString returns this BigInt's decimal representation - with no "n"
+// suffix, which is literal syntax, not part of the value's string
+// representation.
+func (this BigInt) ToString() String {
+	return String(this.Int.String())
+}
+
+// Parent returns BigIntProto.
+func (this BigInt) Parent() Value {
+	return Value(BigIntProto)
+}
+
+// GetProperty looks up key (a String, Symbol, or anything else
+// ToPropertyKey accepts) on BigIntProto: like the other primitives, a
+// BigInt has no properties of its own.
+func (this BigInt) GetProperty(key Value) (Value, error) {
+	return BigIntProto.GetProperty(key)
+}
+
+// SetProperty always fails: a BigInt, like any other primitive, is
+// immutable and cannot have properties added to it.
+func (this BigInt) SetProperty(key Value, value Value) error {
+	return &ErrorMsg{
+		Name:    "TypeError",
+		Message: fmt.Sprintf("cannot create property %q on a bigint", key.ToString()),
+	}
+}
+
+/********************************************************************/
+// Arithmetic.  ECMAScript never implicitly converts between Number
+// and BigInt - "+", "-", "*", "/" and "%" all throw a TypeError if
+// asked to mix them (relational and equality comparisons instead
+// compare the two by mathematical value; see AbstractEquals and
+// AbstractRelational) - so
+// each of these takes a Value (not a BigInt) for other and reports
+// that error itself, rather than leaving the caller to remember to
+// check.
+
+// errCannotMixBigInt is the TypeError thrown by the BigInt arithmetic
+// operations below when asked to operate on a non-BigInt operand.
+func errCannotMixBigInt() error {
+	return &ErrorMsg{
+		Name:    "TypeError",
+		Message: "Cannot mix BigInt and other types, use explicit conversions",
+	}
+}
+
+// asBigInt type-asserts other to a BigInt, returning
+// errCannotMixBigInt if it is not one.
+func asBigInt(other Value) (BigInt, error) {
+	b, ok := other.(BigInt)
+	if !ok {
+		return BigInt{}, errCannotMixBigInt()
+	}
+	return b, nil
+}
+
+// Add returns this + other.
+func (this BigInt) Add(other Value) (BigInt, error) {
+	o, err := asBigInt(other)
+	if err != nil {
+		return BigInt{}, err
+	}
+	return BigInt{new(big.Int).Add(this.Int, o.Int)}, nil
+}
+
+// Sub returns this - other.
+func (this BigInt) Sub(other Value) (BigInt, error) {
+	o, err := asBigInt(other)
+	if err != nil {
+		return BigInt{}, err
+	}
+	return BigInt{new(big.Int).Sub(this.Int, o.Int)}, nil
+}
+
+// Mul returns this * other.
+func (this BigInt) Mul(other Value) (BigInt, error) {
+	o, err := asBigInt(other)
+	if err != nil {
+		return BigInt{}, err
+	}
+	return BigInt{new(big.Int).Mul(this.Int, o.Int)}, nil
+}
+
+// Div returns this / other, truncated towards zero per the BigInt::
+// divide abstract operation (big.Int.Quo truncates the same way;
+// big.Int.Div, which rounds Euclidean-style, would not).
+// It is a RangeError, not a panic, to divide by zero.
+func (this BigInt) Div(other Value) (BigInt, error) {
+	o, err := asBigInt(other)
+	if err != nil {
+		return BigInt{}, err
+	}
+	if o.Sign() == 0 {
+		return BigInt{}, &ErrorMsg{Name: "RangeError", Message: "Division by zero"}
+	}
+	return BigInt{new(big.Int).Quo(this.Int, o.Int)}, nil
+}
+
+// Mod returns the remainder of this / other, with the sign of this,
+// per the BigInt::remainder abstract operation (big.Int.Rem matches
+// this truncating convention, unlike Mod's Euclidean one).
+func (this BigInt) Mod(other Value) (BigInt, error) {
+	o, err := asBigInt(other)
+	if err != nil {
+		return BigInt{}, err
+	}
+	if o.Sign() == 0 {
+		return BigInt{}, &ErrorMsg{Name: "RangeError", Message: "Division by zero"}
+	}
+	return BigInt{new(big.Int).Rem(this.Int, o.Int)}, nil
+}
+
+// Neg returns -this.
+func (this BigInt) Neg() BigInt {
+	return BigInt{new(big.Int).Neg(this.Int)}
+}
+
+// Cmp compares this and other as mathematical values, returning -1,
+// 0 or +1 as this is less than, equal to, or greater than other.  It
+// is the BigInt analogue of the relational and equality operators,
+// none of which this package's == can provide directly (see BigInt's
+// doc comment).
+func (this BigInt) Cmp(other Value) (int, error) {
+	o, err := asBigInt(other)
+	if err != nil {
+		return 0, err
+	}
+	return this.Int.Cmp(o.Int), nil
+}
+
+/********************************************************************/
+// Coercion.  ToNumber and ToBigInt mirror the ES2020 abstract
+// operations of the same name, except that - per spec - neither
+// implicitly converts the other numeric type: ToNumber(bigint) and
+// ToBigInt(number) are both TypeErrors, requiring an explicit
+// Number(...)/BigInt conversion instead.
+
+// ToNumber converts v to a Number following the ES2020 ToNumber
+// abstract operation.
+func ToNumber(v Value) (Number, error) {
+	switch t := v.(type) {
+	case Number:
+		return t, nil
+	case Boolean:
+		if t {
+			return Number(1), nil
+		}
+		return Number(0), nil
+	case Null:
+		return Number(0), nil
+	case Undefined:
+		return Number(math.NaN()), nil
+	case String:
+		return numberFromString(string(t)), nil
+	case BigInt:
+		return 0, &ErrorMsg{
+			Name:    "TypeError",
+			Message: "Cannot convert a BigInt value to a number",
+		}
+	default:
+		return 0, &ErrorMsg{
+			Name:    "TypeError",
+			Message: fmt.Sprintf("Cannot convert %s to a number", v.Type()),
+		}
+	}
+}
+
+// ToBigInt converts v to a BigInt following the ES2020 ToBigInt
+// abstract operation.
+func ToBigInt(v Value) (BigInt, error) {
+	switch t := v.(type) {
+	case BigInt:
+		return t, nil
+	case Boolean:
+		if t {
+			return BigInt{big.NewInt(1)}, nil
+		}
+		return BigInt{big.NewInt(0)}, nil
+	case String:
+		n, ok := bigIntFromString(strings.TrimSpace(string(t)))
+		if !ok {
+			return BigInt{}, &ErrorMsg{
+				Name:    "SyntaxError",
+				Message: fmt.Sprintf("Cannot convert %s to a BigInt", t),
+			}
+		}
+		return BigInt{n}, nil
+	case Number:
+		return BigInt{}, &ErrorMsg{
+			Name:    "TypeError",
+			Message: "Cannot convert a number to a BigInt",
+		}
+	default:
+		return BigInt{}, &ErrorMsg{
+			Name:    "TypeError",
+			Message: fmt.Sprintf("Cannot convert %s to a BigInt", v.Type()),
+		}
+	}
+}
+
+// bigIntFromString implements the StringIntegerLiteral grammar used
+// by ES2020 StringToBigInt: an optionally-signed 0x/0o/0b-prefixed
+// integer, or an optionally-signed run of decimal digits.  Unlike
+// big.Int.SetString's own base-0 auto-detection, a bare leading "0"
+// followed by more decimal digits is NOT treated as a legacy C-style
+// octal literal - StringToBigInt, like StringToNumber, has no such
+// fallback - so "010" must parse as decimal 10, not octal 8.  The
+// empty string (what an all-whitespace string trims to) is 0.
+func bigIntFromString(s string) (*big.Int, bool) {
+	if s == "" {
+		return new(big.Int), true
+	}
+	sign := ""
+	if len(s) > 0 && (s[0] == '+' || s[0] == '-') {
+		if s[0] == '-' {
+			sign = "-"
+		}
+		s = s[1:]
+	}
+	if len(s) == 0 {
+		return nil, false
+	}
+	base := 10
+	if len(s) >= 2 && s[0] == '0' {
+		switch s[1] {
+		case 'x', 'X':
+			base, s = 16, s[2:]
+		case 'o', 'O':
+			base, s = 8, s[2:]
+		case 'b', 'B':
+			base, s = 2, s[2:]
+		}
+	}
+	n := new(big.Int)
+	return n.SetString(sign+s, base)
+}
+
+// numberFromString implements the String-to-Number half of ToNumber
+// (ES5.1 9.3.1 StringToNumber): the empty string (or one consisting
+// only of whitespace) converts to 0; "Infinity"/"+Infinity"/
+// "-Infinity" and unsigned hexadecimal integer literals ("0x10") are
+// recognized alongside ordinary decimal literals; anything else that
+// isn't well-formed converts not to an error but to NaN.
+func numberFromString(s string) Number {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return Number(0)
+	}
+	switch s {
+	case "Infinity", "+Infinity":
+		return Number(math.Inf(1))
+	case "-Infinity":
+		return Number(math.Inf(-1))
+	}
+	if len(s) >= 2 && s[0] == '0' && (s[1] == 'x' || s[1] == 'X') {
+		n, ok := new(big.Int).SetString(s[2:], 16)
+		if !ok || strings.ContainsAny(s[2:], "+-") {
+			return Number(math.NaN())
+		}
+		f, _ := new(big.Float).SetInt(n).Float64()
+		return Number(f)
+	}
+	// strconv.ParseFloat also accepts "inf", "nan" and hex floats,
+	// none of which StringToNumber does.
+	if strings.ContainsAny(s, "iInNxX") {
+		return Number(math.NaN())
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if ne, ok := err.(*strconv.NumError); err != nil && !(ok && ne.Err == strconv.ErrRange) {
+		// Out of range ("1e400") still yields ±Infinity, as it should.
+		return Number(math.NaN())
+	}
+	return Number(f)
+}
+
+/********************************************************************/
+
+// parseBigIntLiteral parses raw - a decimal, hexadecimal, octal or
+// binary integer literal, optionally signed, followed by a trailing
+// "n" - into the BigInt it denotes.
+func parseBigIntLiteral(raw string) BigInt {
+	s := raw[:len(raw)-1] // Strip the trailing "n".
+	sign := ""
+	if len(s) > 0 && (s[0] == '+' || s[0] == '-') {
+		if s[0] == '-' {
+			sign = "-"
+		}
+		s = s[1:]
+	}
+	if len(s) == 0 {
+		panic(fmt.Errorf("malformed BigInt literal %q", raw))
+	}
+	n := new(big.Int)
+	// Base 0 makes SetString recognize the 0x/0o/0b prefixes (and a
+	// bare leading 0 as legacy octal) itself.
+	if _, ok := n.SetString(sign+s, 0); !ok {
+		panic(fmt.Errorf("malformed BigInt literal %q", raw))
+	}
+	return BigInt{n}
+}
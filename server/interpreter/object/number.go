@@ -0,0 +1,154 @@
+/* Copyright 2017 Google Inc.
+ * https://github.com/NeilFraser/CodeCity
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// digitChars are the digits used by ToStringRadix, in the same
+// lowercase a-z order as every other engine's Number.prototype.toString.
+const digitChars = "0123456789abcdefghijklmnopqrstuvwxyz"
+
+// ToString implements the ES5.1 9.8.1 ToString Applied to the Number
+// Type algorithm: it picks the shortest decimal digit string that
+// round-trips back to this Number (via Go's own shortest-round-trip
+// float formatting, which implements the same Steele & White /
+// Grisu-family guarantee the spec requires), then formats it using
+// the spec's rules for plain versus exponential notation.
+func (this Number) ToString() String {
+	f := float64(this)
+	switch {
+	case math.IsNaN(f):
+		return String("NaN")
+	case f == 0:
+		// Covers both +0 and -0: ToString(-0) is "0", not "-0".
+		return String("0")
+	case f < 0:
+		return String("-" + string((-this).ToString()))
+	case math.IsInf(f, 1):
+		return String("Infinity")
+	}
+
+	digits, n := shortestDigits(f)
+	k := len(digits)
+	switch {
+	case k <= n && n <= 21:
+		return String(digits + strings.Repeat("0", n-k))
+	case 0 < n && n <= 21:
+		return String(digits[:n] + "." + digits[n:])
+	case -6 < n && n <= 0:
+		return String("0." + strings.Repeat("0", -n) + digits)
+	default:
+		var sb strings.Builder
+		sb.WriteByte(digits[0])
+		if k > 1 {
+			sb.WriteByte('.')
+			sb.WriteString(digits[1:])
+		}
+		sb.WriteByte('e')
+		exp := n - 1
+		if exp >= 0 {
+			sb.WriteByte('+')
+		} else {
+			sb.WriteByte('-')
+			exp = -exp
+		}
+		sb.WriteString(strconv.Itoa(exp))
+		return String(sb.String())
+	}
+}
+
+// shortestDigits returns the shortest sequence of decimal digits s
+// (with no leading or trailing zeros) such that, together with the
+// integer n, the Number value of s * 10**(n-len(s)) is f exactly -
+// i.e. the s and n of ES5.1 9.8.1 step 5. f must be finite and > 0.
+func shortestDigits(f float64) (digits string, n int) {
+	// 'e' formatting with prec -1 gives Go's shortest-round-trip
+	// digits as d.ddd...e±dd; splitting on "e" and removing the "."
+	// recovers exactly the s and n the spec describes, since Go's
+	// shortest round-trip guarantee is the same property 9.8.1 step 5
+	// requires of s.
+	formatted := strconv.FormatFloat(f, 'e', -1, 64)
+	mantissa, expPart, _ := strings.Cut(formatted, "e")
+	exp, err := strconv.Atoi(expPart)
+	if err != nil {
+		panic(fmt.Sprintf("shortestDigits(%v): malformed exponent %q", f, expPart))
+	}
+	digits = strings.Replace(mantissa, ".", "", 1)
+	return digits, exp + 1
+}
+
+// ToStringRadix implements Number.prototype.toString(radix) for radix
+// 2 through 36 (ES5.1 leaves non-10 radixes implementation-defined;
+// this follows the same general approach V8 and SpiderMonkey use).
+// The integer part is converted exactly, via big.Int; the fractional
+// part is expanded by repeated multiplication against the float's
+// exact dyadic value, stopping once the remainder reaches zero - which
+// happens eventually for any even radix, since every float64 is a
+// dyadic rational - or once a generous digit cap is hit, for the odd
+// radixes in which that never happens exactly.
+func (this Number) ToStringRadix(radix int) (String, error) {
+	if radix < 2 || radix > 36 {
+		return "", &ErrorMsg{
+			Name:    "RangeError",
+			Message: "toString() radix must be between 2 and 36",
+		}
+	}
+	if radix == 10 {
+		return this.ToString(), nil
+	}
+	f := float64(this)
+	switch {
+	case math.IsNaN(f):
+		return String("NaN"), nil
+	case f == 0:
+		return String("0"), nil
+	case f < 0:
+		s, err := Number(-f).ToStringRadix(radix)
+		return String("-" + string(s)), err
+	case math.IsInf(f, 1):
+		return String("Infinity"), nil
+	}
+
+	bf := new(big.Float).SetFloat64(f)
+	wholeInt, _ := bf.Int(nil) // Truncates toward zero == floor, since f > 0.
+	fracF := new(big.Float).Sub(bf, new(big.Float).SetInt(wholeInt))
+	fracRat, _ := fracF.Rat(nil)
+
+	var sb strings.Builder
+	sb.WriteString(wholeInt.Text(radix))
+
+	if fracRat.Sign() != 0 {
+		sb.WriteByte('.')
+		base := big.NewInt(int64(radix))
+		num := new(big.Int).Set(fracRat.Num())
+		den := fracRat.Denom()
+		digit := new(big.Int)
+		const maxFractionDigits = 1100 // Comfortably beyond any float64's exact binary extent (down to the smallest denormal, 2**-1074).
+		for i := 0; i < maxFractionDigits && num.Sign() != 0; i++ {
+			num.Mul(num, base)
+			digit.DivMod(num, den, num)
+			sb.WriteByte(digitChars[digit.Int64()])
+		}
+	}
+	return String(sb.String()), nil
+}
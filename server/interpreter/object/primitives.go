@@ -0,0 +1,290 @@
+/* Copyright 2017 Google Inc.
+ * https://github.com/NeilFraser/CodeCity
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// PrimitiveFromRaw parses raw - the source text of a single ECMAScript
+// primitive literal, exactly as it would appear in a program (or, for
+// a Number, Boolean, Null or Undefined, as produced by its ToString) -
+// and returns the Value it denotes.  It accepts:
+//
+//   - the keyword literals true, false, null and undefined;
+//   - the special numeric word forms NaN, Infinity, +Infinity and
+//     -Infinity;
+//   - single- or double-quoted string literals, with the full set of
+//     CharacterEscapeSequences (\n, \t, etc.), \0, legacy octal
+//     escapes (\1 through \377), \xHH, \uHHHH and \u{...} Unicode
+//     escapes, and line-continuation escapes (a backslash
+//     immediately followed by a line terminator); and
+//   - decimal integer and float literals (with an optional exponent),
+//     hexadecimal (0x...), legacy octal (0...) and modern octal
+//     (0o...), and binary (0b...) integer literals, any of which may
+//     be preceded by a sign; and
+//   - BigInt literals: any of the above integer forms (decimal, hex,
+//     octal or binary; no float or exponent part), followed by an
+//     "n", e.g. "123n" or "0x1Fn".
+//
+// It panics if raw is not well-formed; it does not attempt partial
+// recovery; this is intended for trusted input such as a value's own
+// persisted raw form, not for surfacing syntax errors to an end user.
+func PrimitiveFromRaw(raw string) Value {
+	switch raw {
+	case "true":
+		return Boolean(true)
+	case "false":
+		return Boolean(false)
+	case "null":
+		return Null{}
+	case "undefined":
+		return Undefined{}
+	case "NaN":
+		return Number(math.NaN())
+	case "Infinity", "+Infinity":
+		return Number(math.Inf(1))
+	case "-Infinity":
+		return Number(math.Inf(-1))
+	}
+	if len(raw) == 0 {
+		panic(fmt.Errorf("empty literal"))
+	}
+	switch raw[0] {
+	case '"', '\'':
+		return String(parseStringLiteral(raw))
+	default:
+		if raw[len(raw)-1] == 'n' {
+			return parseBigIntLiteral(raw)
+		}
+		return Number(parseNumericLiteral(raw))
+	}
+}
+
+// parseStringLiteral decodes the body of a single- or double-quoted
+// string literal, including its surrounding quotes, into the string
+// it denotes.
+func parseStringLiteral(raw string) string {
+	if len(raw) < 2 {
+		panic(fmt.Errorf("malformed string literal %q: too short", raw))
+	}
+	quote := raw[0]
+	if quote != '"' && quote != '\'' {
+		panic(fmt.Errorf("malformed string literal %q: invalid quote character", raw))
+	}
+	if raw[len(raw)-1] != quote {
+		panic(fmt.Errorf("malformed string literal %q: missing closing quote", raw))
+	}
+	body := []rune(raw[1 : len(raw)-1])
+	var sb strings.Builder
+	for i := 0; i < len(body); {
+		c := body[i]
+		if c != '\\' {
+			sb.WriteRune(c)
+			i++
+			continue
+		}
+		i++
+		if i >= len(body) {
+			panic(fmt.Errorf("malformed string literal %q: trailing backslash", raw))
+		}
+		e := body[i]
+		switch {
+		case e == '\r':
+			// Line continuation; \r\n counts as a single line
+			// terminator.
+			i++
+			if i < len(body) && body[i] == '\n' {
+				i++
+			}
+		case e == '\n' || e == ' ' || e == ' ':
+			i++ // Line continuation.
+		case e == 'x':
+			if i+3 > len(body) {
+				panic(fmt.Errorf("malformed string literal %q: incomplete \\x escape", raw))
+			}
+			n, err := strconv.ParseUint(string(body[i+1:i+3]), 16, 8)
+			if err != nil {
+				panic(fmt.Errorf("malformed string literal %q: invalid \\x escape", raw))
+			}
+			sb.WriteRune(rune(n))
+			i += 3
+		case e == 'u':
+			n, consumed := parseUnicodeEscape(body[i:], raw)
+			sb.WriteRune(rune(n))
+			i += consumed
+		case e >= '0' && e <= '7':
+			n, consumed := parseOctalDigits(body[i:])
+			sb.WriteRune(rune(n))
+			i += consumed
+		case e == 'n':
+			sb.WriteRune('\n')
+			i++
+		case e == 't':
+			sb.WriteRune('\t')
+			i++
+		case e == 'r':
+			sb.WriteRune('\r')
+			i++
+		case e == 'b':
+			sb.WriteRune('\b')
+			i++
+		case e == 'f':
+			sb.WriteRune('\f')
+			i++
+		case e == 'v':
+			sb.WriteRune('\v')
+			i++
+		default:
+			// Every other SingleEscapeCharacter (\', \", \\) - and,
+			// non-normatively, any other character - escapes to
+			// itself.
+			sb.WriteRune(e)
+			i++
+		}
+	}
+	return sb.String()
+}
+
+// parseUnicodeEscape reads a \uHHHH or \u{H...} escape - r[0] is the
+// 'u' itself - returning its value and the number of runes of r
+// (starting from, and including, that 'u') it occupies.
+func parseUnicodeEscape(r []rune, raw string) (value int64, consumed int) {
+	if len(r) > 1 && r[1] == '{' {
+		end := 2
+		for end < len(r) && r[end] != '}' {
+			end++
+		}
+		if end >= len(r) {
+			panic(fmt.Errorf("malformed string literal %q: unterminated \\u{...} escape", raw))
+		}
+		n, err := strconv.ParseInt(string(r[2:end]), 16, 32)
+		if err != nil {
+			panic(fmt.Errorf("malformed string literal %q: invalid \\u{...} escape", raw))
+		}
+		return n, end + 1
+	}
+	if len(r) < 5 {
+		panic(fmt.Errorf("malformed string literal %q: incomplete \\u escape", raw))
+	}
+	n, err := strconv.ParseInt(string(r[1:5]), 16, 32)
+	if err != nil {
+		panic(fmt.Errorf("malformed string literal %q: invalid \\u escape", raw))
+	}
+	return n, 5
+}
+
+// parseOctalDigits reads a legacy octal escape sequence - "\0" through
+// "\377" - from the 1-3 octal digits at the start of r (r[0] is
+// already known to be one), returning its value and how many digits
+// were consumed.
+func parseOctalDigits(r []rune) (value int, consumed int) {
+	max := 2
+	if r[0] <= '3' {
+		max = 3
+	}
+	if max > len(r) {
+		max = len(r)
+	}
+	for consumed < max && r[consumed] >= '0' && r[consumed] <= '7' {
+		value = value*8 + int(r[consumed]-'0')
+		consumed++
+	}
+	return value, consumed
+}
+
+// parseNumericLiteral parses raw - optionally signed, and either a
+// decimal integer or float (with an optional exponent) or a
+// hexadecimal (0x), octal (0... or 0o...) or binary (0b...) integer -
+// into the float64 it denotes.
+func parseNumericLiteral(raw string) float64 {
+	s := raw
+	sign := 1.0
+	if len(s) > 0 && (s[0] == '+' || s[0] == '-') {
+		if s[0] == '-' {
+			sign = -1
+		}
+		s = s[1:]
+	}
+	if len(s) == 0 {
+		panic(fmt.Errorf("malformed numeric literal %q", raw))
+	}
+
+	if len(s) >= 2 && s[0] == '0' {
+		switch s[1] {
+		case 'x', 'X':
+			n, err := strconv.ParseUint(s[2:], 16, 64)
+			if err != nil {
+				panic(fmt.Errorf("malformed numeric literal %q: %v", raw, err))
+			}
+			return sign * float64(n)
+		case 'o', 'O':
+			n, err := strconv.ParseUint(s[2:], 8, 64)
+			if err != nil {
+				panic(fmt.Errorf("malformed numeric literal %q: %v", raw, err))
+			}
+			return sign * float64(n)
+		case 'b', 'B':
+			n, err := strconv.ParseUint(s[2:], 2, 64)
+			if err != nil {
+				panic(fmt.Errorf("malformed numeric literal %q: %v", raw, err))
+			}
+			return sign * float64(n)
+		default:
+			// Legacy octal: a leading zero followed only by further
+			// octal digits, e.g. "0755".  A leading zero followed by
+			// '.', 'e', '8' or '9' (or nothing) is just a decimal
+			// literal that happens to start with a zero digit, and
+			// falls through to the general case below.
+			if isAllOctalDigits(s[1:]) {
+				n, err := strconv.ParseUint(s[1:], 8, 64)
+				if err != nil {
+					panic(fmt.Errorf("malformed numeric literal %q: %v", raw, err))
+				}
+				return sign * float64(n)
+			}
+		}
+	}
+
+	// strconv.ParseFloat also accepts "inf", "nan" and a second sign,
+	// none of which is a numeric literal.
+	if strings.ContainsAny(s, "iInN") || s[0] == '+' || s[0] == '-' {
+		panic(fmt.Errorf("malformed numeric literal %q", raw))
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		panic(fmt.Errorf("malformed numeric literal %q: %v", raw, err))
+	}
+	return sign * n
+}
+
+// isAllOctalDigits reports whether s is non-empty and consists
+// entirely of octal digits.
+func isAllOctalDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '7' {
+			return false
+		}
+	}
+	return true
+}
@@ -18,6 +18,7 @@ package object
 
 import (
 	"math"
+	"math/big"
 	"testing"
 )
 
@@ -26,23 +27,99 @@ func TestPrimitiveFromRaw(t *testing.T) {
 		raw      string
 		expected Value
 	}{
+		// Keyword literals.
 		{`true`, Boolean(true)},
 		{`false`, Boolean(false)},
 		{`undefined`, Undefined{}},
 		{`null`, Null{}},
+
+		// Numeric word forms.  (NaN is tested separately below, since
+		// NaN != NaN makes it unsuitable for a table of this form.)
+		{`Infinity`, Number(math.Inf(1))},
+		{`+Infinity`, Number(math.Inf(1))},
+		{`-Infinity`, Number(math.Inf(-1))},
+
+		// Decimal integers and floats.
 		{`42`, Number(42)},
+		{`+42`, Number(42)},
+		{`-42`, Number(-42)},
+		{`0`, Number(0)},
+		{`3.14159`, Number(3.14159)},
+		{`.5`, Number(0.5)},
+		{`5.`, Number(5)},
+		{`1e10`, Number(1e10)},
+		{`1.5e+10`, Number(1.5e10)},
+		{`1.5e-10`, Number(1.5e-10)},
+		{`2E3`, Number(2000)},
+
+		// Hex, octal and binary integers.
+		{`0x1F`, Number(31)},
+		{`0X1f`, Number(31)},
+		{`-0x10`, Number(-16)},
+		{`0o17`, Number(15)},
+		{`0O17`, Number(15)},
+		{`0b101`, Number(5)},
+		{`0B101`, Number(5)},
+		{`0755`, Number(493)},
+		{`00`, Number(0)},
+		{`09`, Number(9)}, // Not all-octal-digits: decimal, not legacy octal.
+
+		// Double-quoted strings.
 		{`"Hello, World!"`, String("Hello, World!")},
-		// {`'Hello, World!'`, String("Hello, World!")}, // FIXME
 		{`"foo'bar\"baz"`, String(`foo'bar"baz`)},
-		// {`'foo\'bar"baz'`, String(`foo'bar"baz`)}, // FIXME
+		{`""`, String("")},
+
+		// Single-quoted strings.
+		{`'Hello, World!'`, String("Hello, World!")},
+		{`'foo\'bar"baz'`, String(`foo'bar"baz`)},
+
+		// Escape sequences.
+		{`"\n\t\r\b\f\v\\"`, String("\n\t\r\b\f\v\\")},
+		{`"\0"`, String("\x00")},
+		{`"\x41\x42"`, String("AB")},
+		{"\"\\u0041\\u0042\"", String("AB")},
+		{`"\u{1F600}"`, String("\U0001F600")},
+		{`"\101\102"`, String("AB")},         // legacy octal escapes
+		{"\"foo\\\nbar\"", String("foobar")}, // line continuation
+		{`"unrecognized \q escape"`, String("unrecognized q escape")},
 	}
 
 	for _, c := range tests {
-		if v := NewFromRaw(c.raw); v != c.expected {
-			t.Errorf("newFromRaw(%v) == %v (%T)\n(expected %v (%T))",
+		if v := PrimitiveFromRaw(c.raw); v != c.expected {
+			t.Errorf("PrimitiveFromRaw(%v) == %v (%T)\n(expected %v (%T))",
 				c.raw, v, v, c.expected, c.expected)
 		}
 	}
+
+	if v, ok := PrimitiveFromRaw(`NaN`).(Number); !ok || !math.IsNaN(float64(v)) {
+		t.Errorf("PrimitiveFromRaw(\"NaN\") == %v (expected NaN)", v)
+	}
+}
+
+func TestPrimitiveFromRawPanics(t *testing.T) {
+	var tests = []string{
+		``,
+		`"unterminated`,
+		`'mismatched"`,
+		`"bad \x escape"`,
+		`"bad \xZZ"`,
+		`"bad \u12"`,
+		`"bad \u{12"`,
+		`0x`,
+		`0b2`,
+		`1.2.3`,
+		`"trailing backslash\`,
+	}
+	for _, raw := range tests {
+		func() {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Errorf("PrimitiveFromRaw(%q) did not panic", raw)
+				}
+			}()
+			PrimitiveFromRaw(raw)
+		}()
+	}
 }
 
 func TestIsTruthy(t *testing.T) {
@@ -70,6 +147,9 @@ func TestIsTruthy(t *testing.T) {
 		{Number(math.NaN()), false},
 		{Number(math.MaxFloat64), true},
 		{Number(math.SmallestNonzeroFloat64), true},
+		{BigInt{big.NewInt(0)}, false},
+		{BigInt{big.NewInt(1)}, true},
+		{BigInt{big.NewInt(-1)}, true},
 	}
 	for _, c := range tests {
 		if v := c.input.ToBoolean(); v != Boolean(c.expected) {
@@ -123,21 +203,422 @@ func TestString(t *testing.T) {
 	}
 }
 
+func TestBigInt(t *testing.T) {
+	n := BigInt{big.NewInt(0)}
+	if n.Parent() != Value(BigIntProto) {
+		t.Errorf("%v.Parent() != BigIntProto", n)
+	}
+	if n.Parent().Parent() != Value(ObjectProto) {
+		t.Errorf("%v.Parent().Parent() != ObjectProto", n)
+	}
+	if n.Type() != "bigint" {
+		t.Errorf(`%v.Type() == %q (expected "bigint")`, n, n.Type())
+	}
+}
+
+func TestBigIntFromRaw(t *testing.T) {
+	var tests = []struct {
+		raw      string
+		expected int64
+	}{
+		{`0n`, 0},
+		{`123n`, 123},
+		{`-123n`, -123},
+		{`+123n`, 123},
+		{`0x1Fn`, 31},
+		{`0o17n`, 15},
+		{`0b101n`, 5},
+	}
+	for _, c := range tests {
+		v := PrimitiveFromRaw(c.raw)
+		b, ok := v.(BigInt)
+		if !ok {
+			t.Errorf("PrimitiveFromRaw(%v) == %v (%T) (expected a BigInt)", c.raw, v, v)
+			continue
+		}
+		if b.Int.Cmp(big.NewInt(c.expected)) != 0 {
+			t.Errorf("PrimitiveFromRaw(%v) == %v (expected %v)", c.raw, b, c.expected)
+		}
+	}
+}
+
+func TestBigIntFromRawPanics(t *testing.T) {
+	var tests = []string{
+		`n`,
+		`+n`,
+		`0xn`,
+	}
+	for _, raw := range tests {
+		func() {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Errorf("PrimitiveFromRaw(%q) did not panic", raw)
+				}
+			}()
+			PrimitiveFromRaw(raw)
+		}()
+	}
+}
+
+func TestBigIntArithmetic(t *testing.T) {
+	a := BigInt{big.NewInt(10)}
+	b := BigInt{big.NewInt(3)}
+
+	if v, err := a.Add(b); err != nil || v.Int64() != 13 {
+		t.Errorf("10n.Add(3n) == %v, %v (expected 13, nil)", v, err)
+	}
+	if v, err := a.Sub(b); err != nil || v.Int64() != 7 {
+		t.Errorf("10n.Sub(3n) == %v, %v (expected 7, nil)", v, err)
+	}
+	if v, err := a.Mul(b); err != nil || v.Int64() != 30 {
+		t.Errorf("10n.Mul(3n) == %v, %v (expected 30, nil)", v, err)
+	}
+	if v, err := a.Div(b); err != nil || v.Int64() != 3 {
+		t.Errorf("10n.Div(3n) == %v, %v (expected 3, nil)", v, err)
+	}
+	if v, err := a.Mod(b); err != nil || v.Int64() != 1 {
+		t.Errorf("10n.Mod(3n) == %v, %v (expected 1, nil)", v, err)
+	}
+	if v := a.Neg(); v.Int64() != -10 {
+		t.Errorf("10n.Neg() == %v (expected -10)", v)
+	}
+	if c, err := a.Cmp(b); err != nil || c <= 0 {
+		t.Errorf("10n.Cmp(3n) == %v, %v (expected >0, nil)", c, err)
+	}
+
+	if _, err := a.Add(Number(3)); err == nil {
+		t.Errorf("10n.Add(3) did not return an error")
+	}
+	if _, err := a.Div(BigInt{big.NewInt(0)}); err == nil {
+		t.Errorf("10n.Div(0n) did not return an error")
+	}
+}
+
+func TestBigIntCoercion(t *testing.T) {
+	if _, err := ToNumber(BigInt{big.NewInt(1)}); err == nil {
+		t.Errorf("ToNumber(1n) did not return an error")
+	}
+	if _, err := ToBigInt(Number(1)); err == nil {
+		t.Errorf("ToBigInt(1) did not return an error")
+	}
+	if v, err := ToNumber(Boolean(true)); err != nil || v != Number(1) {
+		t.Errorf("ToNumber(true) == %v, %v (expected 1, nil)", v, err)
+	}
+	if v, err := ToBigInt(String("42")); err != nil || v.Int64() != 42 {
+		t.Errorf(`ToBigInt("42") == %v, %v (expected 42, nil)`, v, err)
+	}
+	// StringToBigInt has no legacy-octal fallback for a bare leading
+	// zero - unlike big.Int.SetString's own base-0 auto-detection,
+	// "010" must parse as decimal 10, not octal 8.
+	if v, err := ToBigInt(String("010")); err != nil || v.Int64() != 10 {
+		t.Errorf(`ToBigInt("010") == %v, %v (expected 10, nil)`, v, err)
+	}
+	if v, err := ToBigInt(String("0x1F")); err != nil || v.Int64() != 31 {
+		t.Errorf(`ToBigInt("0x1F") == %v, %v (expected 31, nil)`, v, err)
+	}
+	if v, err := ToNumber(String("  3.5  ")); err != nil || v != Number(3.5) {
+		t.Errorf(`ToNumber("  3.5  ") == %v, %v (expected 3.5, nil)`, v, err)
+	}
+}
+
+func TestSymbol(t *testing.T) {
+	sym := NewSymbol("foo")
+	if sym.Type() != "symbol" {
+		t.Errorf(`%v.Type() == %q (expected "symbol")`, sym, sym.Type())
+	}
+	if sym.ToBoolean() != Boolean(true) {
+		t.Errorf("%v.ToBoolean() != true", sym)
+	}
+	if sym.ToString() != String("Symbol(foo)") {
+		t.Errorf(`%v.ToString() == %q (expected "Symbol(foo)")`, sym, sym.ToString())
+	}
+	if sym.Parent() != Value(SymbolProto) {
+		t.Errorf("%v.Parent() != SymbolProto", sym)
+	}
+	if sym.Parent().Parent() != Value(ObjectProto) {
+		t.Errorf("%v.Parent().Parent() != ObjectProto", sym)
+	}
+	if _, err := ToNumber(sym); err == nil {
+		t.Errorf("ToNumber(%v) did not return an error", sym)
+	}
+
+	other := NewSymbol("foo")
+	if sym == other {
+		t.Errorf("two NewSymbol(\"foo\") calls produced equal Symbols")
+	}
+	if err := sym.SetProperty(String("bar"), Number(1)); err == nil {
+		t.Errorf("%v.SetProperty(...) did not return an error", sym)
+	}
+}
+
+func TestSymbolRegistry(t *testing.T) {
+	a := SymbolFor("shared")
+	b := SymbolFor("shared")
+	if a != b {
+		t.Errorf(`SymbolFor("shared") != SymbolFor("shared")`)
+	}
+	if key, ok := SymbolKeyFor(a); !ok || key != "shared" {
+		t.Errorf(`SymbolKeyFor(SymbolFor("shared")) == %q, %v (expected "shared", true)`, key, ok)
+	}
+	if _, ok := SymbolKeyFor(NewSymbol("unregistered")); ok {
+		t.Errorf("SymbolKeyFor(NewSymbol(...)) returned ok == true for an unregistered symbol")
+	}
+	if _, ok := SymbolKeyFor(SymbolIterator); ok {
+		t.Errorf("SymbolKeyFor(SymbolIterator) returned ok == true; well-known symbols must not be in the registry")
+	}
+}
+
+// TestSymbolKeyedProperty checks that a Symbol key passed to
+// GetProperty/SetProperty is passed through unstringified - it must
+// not be coerced via ToString into e.g. "Symbol(tag)" and looked up
+// as an ordinary string-keyed property, which would collide with a
+// ToString-equal property of that name.
+func TestSymbolKeyedProperty(t *testing.T) {
+	sym := NewSymbol("tag")
+	s := String("hello")
+	if _, err := s.GetProperty(sym); err == nil {
+		t.Errorf("%v.GetProperty(%v) did not return an error "+
+			"(StringProto has no property for an arbitrary Symbol key)", s, sym)
+	}
+	n := BigInt{big.NewInt(1)}
+	if err := n.SetProperty(sym, Number(1)); err == nil {
+		t.Errorf("%v.SetProperty(%v, 1) did not return an error", n, sym)
+	}
+}
+
+func TestToNumber(t *testing.T) {
+	cases := []struct {
+		in       Value
+		expected Number
+	}{
+		{Undefined{}, Number(math.NaN())},
+		{Null{}, Number(0)},
+		{Boolean(true), Number(1)},
+		{Boolean(false), Number(0)},
+		{Number(42), Number(42)},
+		{String(""), Number(0)},
+		{String("   "), Number(0)},
+		{String("0"), Number(0)},
+		{String("  0x10  "), Number(16)},
+		{String("Infinity"), Number(math.Inf(1))},
+		{String("-Infinity"), Number(math.Inf(-1))},
+		{String("abc"), Number(math.NaN())},
+	}
+	for _, c := range cases {
+		v, err := ToNumber(c.in)
+		if err != nil {
+			t.Errorf("ToNumber(%#v) returned error %v", c.in, err)
+			continue
+		}
+		if math.IsNaN(float64(c.expected)) {
+			if !math.IsNaN(float64(v)) {
+				t.Errorf("ToNumber(%#v) == %v (expected NaN)", c.in, v)
+			}
+			continue
+		}
+		if v != c.expected {
+			t.Errorf("ToNumber(%#v) == %v (expected %v)", c.in, v, c.expected)
+		}
+	}
+	if _, err := ToNumber(BigInt{big.NewInt(1)}); err == nil {
+		t.Errorf("ToNumber(1n) did not return an error")
+	}
+}
+
+func TestToInteger(t *testing.T) {
+	cases := []struct {
+		in       Value
+		expected Number
+	}{
+		{Number(math.NaN()), Number(0)},
+		{Number(math.Inf(1)), Number(math.Inf(1))},
+		{Number(math.Inf(-1)), Number(math.Inf(-1))},
+		{Number(3.7), Number(3)},
+		{Number(-3.7), Number(-3)},
+		{Boolean(true), Number(1)},
+		{String("  42  "), Number(42)},
+	}
+	for _, c := range cases {
+		v, err := ToInteger(c.in)
+		if err != nil || v != c.expected {
+			t.Errorf("ToInteger(%#v) == %v, %v (expected %v, nil)", c.in, v, err, c.expected)
+		}
+	}
+}
+
+func TestToInt32AndToUint32(t *testing.T) {
+	cases := []struct {
+		in        Value
+		wantInt32 int32
+		wantUint  uint32
+	}{
+		{Number(0), 0, 0},
+		{Number(42), 42, 42},
+		{Number(-1), -1, 4294967295},
+		{Number(4294967296), 0, 0},                    // 2^32
+		{Number(4294967297), 1, 1},                    // 2^32 + 1
+		{Number(2147483648), -2147483648, 2147483648}, // 2^31
+		{Number(math.NaN()), 0, 0},
+		{Number(math.Inf(1)), 0, 0},
+	}
+	for _, c := range cases {
+		if v, err := ToInt32(c.in); err != nil || v != c.wantInt32 {
+			t.Errorf("ToInt32(%v) == %v, %v (expected %v, nil)", c.in, v, err, c.wantInt32)
+		}
+		if v, err := ToUint32(c.in); err != nil || v != c.wantUint {
+			t.Errorf("ToUint32(%v) == %v, %v (expected %v, nil)", c.in, v, err, c.wantUint)
+		}
+	}
+}
+
+func TestToUint16(t *testing.T) {
+	cases := []struct {
+		in       Value
+		expected uint16
+	}{
+		{Number(0), 0},
+		{Number(65535), 65535},
+		{Number(65536), 0},
+		{Number(65537), 1},
+		{Number(-1), 65535},
+		{Number(math.NaN()), 0},
+	}
+	for _, c := range cases {
+		if v, err := ToUint16(c.in); err != nil || v != c.expected {
+			t.Errorf("ToUint16(%v) == %v, %v (expected %v, nil)", c.in, v, err, c.expected)
+		}
+	}
+}
+
+func TestToPrimitiveAndToObject(t *testing.T) {
+	for _, v := range []Value{Undefined{}, Null{}, Boolean(true), Number(1), String("s"), BigInt{big.NewInt(1)}} {
+		p, err := ToPrimitive(v, "default")
+		if err != nil || p != v {
+			t.Errorf("ToPrimitive(%#v, \"default\") == %v, %v (expected %v, nil)", v, p, err, v)
+		}
+	}
+	for _, v := range []Value{Undefined{}, Null{}} {
+		if _, err := ToObject(v); err == nil {
+			t.Errorf("ToObject(%#v) did not return an error", v)
+		}
+	}
+}
+
+func TestToPropertyKey(t *testing.T) {
+	if k, err := ToPropertyKey(Number(42)); err != nil || k != String("42") {
+		t.Errorf("ToPropertyKey(42) == %q, %v (expected \"42\", nil)", k, err)
+	}
+	if k, err := ToPropertyKey(String("foo")); err != nil || k != String("foo") {
+		t.Errorf("ToPropertyKey(\"foo\") == %q, %v (expected \"foo\", nil)", k, err)
+	}
+	sym := NewSymbol("foo")
+	if k, err := ToPropertyKey(sym); err != nil || k != Value(sym) {
+		t.Errorf("ToPropertyKey(%v) == %v, %v (expected %v, nil)", sym, k, err, sym)
+	}
+}
+
+func TestStrictEquals(t *testing.T) {
+	cases := []struct {
+		a, b     Value
+		expected bool
+	}{
+		{Undefined{}, Undefined{}, true},
+		{Undefined{}, Null{}, false},
+		{Null{}, Null{}, true},
+		{Number(1), Number(1), true},
+		{Number(1), Number(1.0000001), false},
+		{Number(math.NaN()), Number(math.NaN()), false},
+		{Number(0), Number(0), true},
+		{String("a"), String("a"), true},
+		{String("a"), String("b"), false},
+		{Boolean(true), Boolean(true), true},
+		{Boolean(true), Boolean(false), false},
+		{Number(1), String("1"), false},
+		{BigInt{big.NewInt(1)}, BigInt{big.NewInt(1)}, true},
+		{BigInt{big.NewInt(1)}, Number(1), false},
+	}
+	for _, c := range cases {
+		if got := StrictEquals(c.a, c.b); got != c.expected {
+			t.Errorf("StrictEquals(%#v, %#v) == %v (expected %v)", c.a, c.b, got, c.expected)
+		}
+	}
+}
+
+func TestAbstractEquals(t *testing.T) {
+	cases := []struct {
+		a, b     Value
+		expected bool
+	}{
+		{Undefined{}, Null{}, true},
+		{Null{}, Undefined{}, true},
+		{Null{}, Number(0), false},
+		{Number(1), String("1"), true},
+		{String("1"), Number(1), true},
+		{Boolean(true), Number(1), true},
+		{Boolean(false), Number(0), true},
+		{Number(0), Boolean(false), true},
+		{String(""), Boolean(false), true},
+		{BigInt{big.NewInt(1)}, Number(1), true},
+		{Number(1), BigInt{big.NewInt(1)}, true},
+		{BigInt{big.NewInt(1)}, String("1"), true},
+		{BigInt{big.NewInt(1)}, Number(1.5), false},
+		{Number(math.NaN()), Number(math.NaN()), false},
+	}
+	for _, c := range cases {
+		got, err := AbstractEquals(c.a, c.b)
+		if err != nil {
+			t.Errorf("AbstractEquals(%#v, %#v) returned error %v", c.a, c.b, err)
+			continue
+		}
+		if got != c.expected {
+			t.Errorf("AbstractEquals(%#v, %#v) == %v (expected %v)", c.a, c.b, got, c.expected)
+		}
+	}
+}
+
+func TestAbstractRelational(t *testing.T) {
+	cases := []struct {
+		a, b     Value
+		expected Value
+	}{
+		{Number(1), Number(2), Boolean(true)},
+		{Number(2), Number(1), Boolean(false)},
+		{String("a"), String("b"), Boolean(true)},
+		{String("b"), String("a"), Boolean(false)},
+		{Number(math.NaN()), Number(1), Undefined{}},
+		{Number(1), Number(math.NaN()), Undefined{}},
+		{BigInt{big.NewInt(1)}, Number(2), Boolean(true)},
+		{Number(2), BigInt{big.NewInt(1)}, Boolean(false)},
+		{BigInt{big.NewInt(1)}, BigInt{big.NewInt(2)}, Boolean(true)},
+		{String("10"), Number(9), Boolean(false)},
+	}
+	for _, c := range cases {
+		got, err := AbstractRelational(c.a, c.b, true)
+		if err != nil {
+			t.Errorf("AbstractRelational(%#v, %#v) returned error %v", c.a, c.b, err)
+			continue
+		}
+		if got != c.expected {
+			t.Errorf("AbstractRelational(%#v, %#v) == %v (expected %v)", c.a, c.b, got, c.expected)
+		}
+	}
+}
+
 func TestStringLength(t *testing.T) {
-	v, err := String("").GetProperty("length")
+	v, err := String("").GetProperty(String("length"))
 	if v != Number(0) || err != nil {
 		t.Errorf("String(\"\").GetProperty(\"length\") == %v, %v"+
 			"(expected 0, nil)", v, err)
 	}
 
-	v, err = String("Hello, World!").GetProperty("length")
+	v, err = String("Hello, World!").GetProperty(String("length"))
 	if v != Number(13) || err != nil {
 		t.Errorf("String(\"కోడ్ సిటీ\").GetProperty(\"length\") == %v, %v "+
 			"(expected 13, nil)", v, err)
 	}
 
 	// "Code City" in Telugu (according to translate.google.com):
-	v, err = String("కోడ్ సిటీ").GetProperty("length")
+	v, err = String("కోడ్ సిటీ").GetProperty(String("length"))
 	if v != Number(9) || err != nil {
 		t.Errorf("String(\"కోడ్ సిటీ\").GetProperty(\"length\") == %v, %v "+
 			"(expected 9, nil)", v, err)
@@ -145,12 +626,94 @@ func TestStringLength(t *testing.T) {
 
 }
 
+// TestStringNonCanonicalIndex checks that only a canonical numeric
+// index string (ES2015 7.1.16 CanonicalNumericIndexString - exactly
+// what ToString(index) would itself produce) is treated as an indexed
+// access; any other numeric-looking key, such as a zero-padded index,
+// must fall through to StringProto like any other ordinary property
+// name.
+func TestStringNonCanonicalIndex(t *testing.T) {
+	s := String("abc")
+	if _, err := s.GetProperty(String("01")); err == nil {
+		t.Errorf(`String("abc").GetProperty("01") did not return an error ` +
+			`("01" is not a canonical index string for 1)`)
+	}
+	if v, err := s.GetProperty(String("1")); v != String("b") || err != nil {
+		t.Errorf(`String("abc").GetProperty("1") == %v, %v (expected "b", nil)`, v, err)
+	}
+}
+
+// TestStringAstral checks UTF-16 code-unit semantics - length,
+// indexing and charAt/charCodeAt - for astral-plane (non-BMP)
+// characters, which Go represents as one rune but ECMAScript, per
+// spec, represents as a surrogate pair of two UTF-16 code units.
+func TestStringAstral(t *testing.T) {
+	// U+10437 DESERET SMALL LETTER YEE, encoded in UTF-16 as the
+	// surrogate pair 0xD801 0xDC37 - so "𐐷".length is 2, not 1.
+	deseret := String("𐐷")
+	if v, err := deseret.GetProperty(String("length")); v != Number(2) || err != nil {
+		t.Errorf(`String("𐐷").GetProperty("length") == %v, %v (expected 2, nil)`, v, err)
+	}
+
+	// U+1F600 GRINNING FACE: also astral, also a surrogate pair.
+	emoji := String("😀")
+	if v, err := emoji.GetProperty(String("length")); v != Number(2) || err != nil {
+		t.Errorf(`String("😀").GetProperty("length") == %v, %v (expected 2, nil)`, v, err)
+	}
+
+	// U+1D49C MATHEMATICAL SCRIPT CAPITAL A, followed by "B": the
+	// indexed lookups must return each surrogate half individually,
+	// not the combined astral character or the following BMP one.
+	// (A lone surrogate has no valid UTF-8 encoding, so - like every
+	// other engine built on UTF-8 rather than WTF-8 - the Value this
+	// package returns for such an index can't be byte-compared against
+	// a Go string literal; CharCodeAt, which reports the raw code-unit
+	// value rather than trying to re-encode it, is checked instead.)
+	mixed := String("𝒜B")
+	if v, err := mixed.GetProperty(String("length")); v != Number(3) || err != nil {
+		t.Errorf(`String("𝒜B").GetProperty("length") == %v, %v (expected 3, nil)`, v, err)
+	}
+	if _, err := mixed.GetProperty(String("0")); err != nil {
+		t.Errorf(`String("𝒜B").GetProperty("0") returned an error: %v`, err)
+	}
+	b, err := mixed.GetProperty(String("2"))
+	if b != String("B") || err != nil {
+		t.Errorf(`String("𝒜B").GetProperty("2") == %v, %v (expected "B", nil)`, b, err)
+	}
+	if _, err := mixed.GetProperty(String("1")); err != nil {
+		t.Errorf(`String("𝒜B").GetProperty("1") returned an error: %v`, err)
+	}
+	if n := mixed.CharCodeAt(0); n != Number(0xD835) {
+		t.Errorf(`String("𝒜B").CharCodeAt(0) == %v (expected 0xD835)`, n)
+	}
+	if n := mixed.CharCodeAt(1); n != Number(0xDC9C) {
+		t.Errorf(`String("𝒜B").CharCodeAt(1) == %v (expected 0xDC9C)`, n)
+	}
+	if n := mixed.CharCodeAt(2); n != Number('B') {
+		t.Errorf(`String("𝒜B").CharCodeAt(2) == %v (expected 'B')`, n)
+	}
+
+	if c := deseret.CharAt(2); c != String("") {
+		t.Errorf(`String("𐐷").CharAt(2) == %q (expected "")`, c)
+	}
+
+	if n := deseret.CharCodeAt(0); n != Number(0xD801) {
+		t.Errorf("String(\"𐐷\").CharCodeAt(0) == %v (expected 0xD801)", n)
+	}
+	if n := deseret.CharCodeAt(1); n != Number(0xDC37) {
+		t.Errorf("String(\"𐐷\").CharCodeAt(1) == %v (expected 0xDC37)", n)
+	}
+	if n := deseret.CharCodeAt(2); !math.IsNaN(float64(n)) {
+		t.Errorf("String(\"𐐷\").CharCodeAt(2) == %v (expected NaN)", n)
+	}
+}
+
 func TestNull(t *testing.T) {
 	n := Null{}
 	if v := n.Type(); v != "object" {
 		t.Errorf("Null{}.Type() == %v (expected \"object\")", v)
 	}
-	if v, e := n.GetProperty("foo"); e == nil {
+	if v, e := n.GetProperty(String("foo")); e == nil {
 		t.Errorf("Null{}.GetProperty(\"foo\") == %v, %v "+
 			"(expected nil, !nil)", v, e)
 	}
@@ -190,12 +753,26 @@ func TestToString(t *testing.T) {
 		{String("foo"), "foo"},
 		{String("\"foo\""), "\"foo\""},
 		{Number(0), "0"},
-		{Number(math.Copysign(0, -1)), "-0"},
+		{Number(math.Copysign(0, -1)), "0"}, // ToString(-0) is "0", not "-0".
 		{Number(math.Inf(+1)), "Infinity"},
 		{Number(math.Inf(-1)), "-Infinity"},
 		{Number(math.NaN()), "NaN"},
-		// FIXME: add test cases for decimal -> scientific notation
-		// transition threshold.
+
+		// Decimal <-> exponential transition thresholds (ES5.1 9.8.1
+		// steps 6-9): n > 21 or n <= -6 switches to exponential.
+		{Number(1e20), "100000000000000000000"},
+		{Number(1e21), "1e+21"},
+		{Number(1e-6), "0.000001"},
+		{Number(1e-7), "1e-7"},
+		{Number(999999999999999934464.0), "1e+21"}, // Rounds to exactly 1e21 in float64.
+		{Number(0.1), "0.1"},
+		{Number(0.1 + 0.2), "0.30000000000000004"},
+		{Number(math.MaxFloat64), "1.7976931348623157e+308"},
+		{Number(math.SmallestNonzeroFloat64), "5e-324"}, // Smallest denormal.
+
+		{BigInt{big.NewInt(0)}, "0"},
+		{BigInt{big.NewInt(-42)}, "-42"},
+		{BigInt{big.NewInt(9007199254740993)}, "9007199254740993"},
 	}
 	for _, c := range tests {
 		if v := c.input.ToString(); v != String(c.expected) {
@@ -203,4 +780,37 @@ func TestToString(t *testing.T) {
 				"(expected %v)", c.input, c.input, v, c.expected)
 		}
 	}
-}
\ No newline at end of file
+}
+
+func TestToStringRadix(t *testing.T) {
+	cases := []struct {
+		input    Number
+		radix    int
+		expected string
+	}{
+		{Number(255), 16, "ff"},
+		{Number(255), 2, "11111111"},
+		{Number(-255), 16, "-ff"},
+		{Number(0), 16, "0"},
+		{Number(8), 8, "10"},
+		{Number(35), 36, "z"},
+		{Number(0.1), 2, "0.0001100110011001100110011001100110011001100110011001101"},
+	}
+	for _, c := range cases {
+		v, err := c.input.ToStringRadix(c.radix)
+		if err != nil || v != String(c.expected) {
+			t.Errorf("(%v).ToStringRadix(%d) == %q, %v (expected %q, nil)",
+				c.input, c.radix, v, err, c.expected)
+		}
+	}
+
+	if _, err := Number(1).ToStringRadix(1); err == nil {
+		t.Errorf("(1).ToStringRadix(1) did not return an error")
+	}
+	if _, err := Number(1).ToStringRadix(37); err == nil {
+		t.Errorf("(1).ToStringRadix(37) did not return an error")
+	}
+	if v, err := Number(10).ToStringRadix(10); err != nil || v != String("10") {
+		t.Errorf(`(10).ToStringRadix(10) == %q, %v (expected "10", nil)`, v, err)
+	}
+}
@@ -0,0 +1,94 @@
+/* Copyright 2017 Google Inc.
+ * https://github.com/NeilFraser/CodeCity
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"math"
+	"strconv"
+	"unicode/utf16"
+)
+
+// This file implements the parts of String's behaviour that ECMAScript
+// defines in terms of UTF-16 code units rather than Unicode code
+// points: its "length" property, indexed (numeric-key) property
+// access, and the String.prototype.charAt/charCodeAt built-ins.  This
+// package stores a String as ordinary UTF-8 Go string data (see
+// ToString's callers, which re-encode to UTF-8 at the boundary); the
+// UTF-16 view used below is computed lazily, on each call, rather
+// than cached, since most Strings are never indexed at all.
+
+// utf16Units returns this string's UTF-16 code units - what
+// ECMAScript considers a String's elements - re-encoding astral-plane
+// characters (outside the Basic Multilingual Plane) as surrogate
+// pairs, exactly as V8 and SpiderMonkey do.
+func (this String) utf16Units() []uint16 {
+	return utf16.Encode([]rune(string(this)))
+}
+
+// GetProperty implements property access on a String: "length"
+// returns the number of UTF-16 code units (not Unicode code points,
+// and not bytes); a key that is a canonical numeric index string (per
+// ES2015 7.1.16 CanonicalNumericIndexString - i.e. exactly what
+// ToString(index) itself would produce, so no leading zeros, no
+// leading "+", etc.) within range returns the single-code-unit
+// substring at that index (which, per spec, may be one half of a
+// surrogate pair - it is not validated or combined with its partner);
+// anything else (including a Symbol key, which is passed straight
+// through without stringifying) is looked up on StringProto.
+//
+// A lone surrogate returned this way has no valid UTF-8 encoding, so
+// unlike a real UTF-16-backed engine, re-decoding it here yields the
+// Unicode replacement character rather than the original code unit;
+// CharCodeAt, not indexing, is the lossless way to inspect it.
+func (this String) GetProperty(key Value) (Value, error) {
+	if _, ok := key.(Symbol); ok {
+		return StringProto.GetProperty(key)
+	}
+	units := this.utf16Units()
+	k := string(key.ToString())
+	if k == "length" {
+		return Number(len(units)), nil
+	}
+	if i, err := strconv.ParseUint(k, 10, 64); err == nil &&
+		strconv.FormatUint(i, 10) == k && i < uint64(len(units)) {
+		return String(utf16.Decode(units[i : i+1])), nil
+	}
+	return StringProto.GetProperty(key)
+}
+
+// CharAt implements String.prototype.charAt: the single-code-unit
+// substring at the given UTF-16 index, or the empty string if index
+// is out of range.
+func (this String) CharAt(index int) String {
+	units := this.utf16Units()
+	if index < 0 || index >= len(units) {
+		return String("")
+	}
+	return String(utf16.Decode(units[index : index+1]))
+}
+
+// CharCodeAt implements String.prototype.charCodeAt: the numeric
+// value of the UTF-16 code unit at the given index (which, for an
+// astral-plane character, is one half of a surrogate pair, not its
+// full code point), or NaN if index is out of range.
+func (this String) CharCodeAt(index int) Number {
+	units := this.utf16Units()
+	if index < 0 || index >= len(units) {
+		return Number(math.NaN())
+	}
+	return Number(units[index])
+}
@@ -0,0 +1,152 @@
+/* Copyright 2017 Google Inc.
+ * https://github.com/NeilFraser/CodeCity
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package object
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Symbol is a primitive Value implementing the ECMAScript 2015 Symbol
+// type: a unique, immutable token, optionally carrying a human-readable
+// description, usable as a property key alongside (and distinct from)
+// String keys.  Two Symbols are equal (under ==, and under this
+// package's own SameValue-style comparisons) only if they are the
+// same Symbol - even if their descriptions happen to match - which is
+// why this holds a package-private id rather than just desc: without
+// it, Symbol("x") would inadvertently equal a second, distinct
+// Symbol("x").
+type Symbol struct {
+	id   uint64
+	desc string
+}
+
+// SymbolProto is the prototype of all Symbol values, analogous to
+// NumberProto, StringProto, BooleanProto and BigIntProto.
+var SymbolProto = New(nil, ObjectProto)
+
+var nextSymbolID uint64
+var symbolIDMu sync.Mutex
+
+// NewSymbol returns a new Symbol with the given description (which,
+// per spec, is advisory only - it appears in the Symbol's ToString
+// and nowhere else - and does not affect the Symbol's identity).
+func NewSymbol(desc string) Symbol {
+	symbolIDMu.Lock()
+	nextSymbolID++
+	id := nextSymbolID
+	symbolIDMu.Unlock()
+	return Symbol{id: id, desc: desc}
+}
+
+// IsPrimitive always returns true: a Symbol, like a Number or String,
+// is a primitive value, not an Object.
+func (this Symbol) IsPrimitive() bool {
+	return true
+}
+
+// Type returns "symbol", per the ECMAScript typeof operator.
+func (this Symbol) Type() string {
+	return "symbol"
+}
+
+// ToBoolean always returns true: every Symbol is truthy.
+func (this Symbol) ToBoolean() Boolean {
+	return Boolean(true)
+}
+
+// ToString returns "Symbol(desc)".  (Unlike every other primitive,
+// real ECMAScript actually throws a TypeError if a Symbol undergoes
+// implicit ToString - e.g. via string concatenation - precisely to
+// catch the mistake of using it as an ordinary string; that
+// restriction belongs in the evaluator, which is where implicit vs.
+// explicit conversion is distinguished, not here.)
+func (this Symbol) ToString() String {
+	return String(fmt.Sprintf("Symbol(%s)", this.desc))
+}
+
+// Parent returns SymbolProto.
+func (this Symbol) Parent() Value {
+	return Value(SymbolProto)
+}
+
+// GetProperty looks up key on SymbolProto: like the other primitives,
+// a Symbol has no properties of its own.
+func (this Symbol) GetProperty(key Value) (Value, error) {
+	return SymbolProto.GetProperty(key)
+}
+
+// SetProperty always fails: a Symbol, like any other primitive, is
+// immutable and cannot have properties added to it.
+func (this Symbol) SetProperty(key Value, value Value) error {
+	return &ErrorMsg{
+		Name:    "TypeError",
+		Message: fmt.Sprintf("cannot create property %q on a symbol", key.ToString()),
+	}
+}
+
+/********************************************************************/
+// The global Symbol registry (ES2015 6.1.5.1): Symbol.for(key) returns
+// the same Symbol for the same key on every call, across the whole
+// program, in contrast to NewSymbol (= the Symbol(desc) constructor
+// call), which always returns a fresh, distinct Symbol.
+
+var symbolRegistry = make(map[string]Symbol)
+var symbolRegistryMu sync.Mutex
+
+// SymbolFor implements Symbol.for(key): it returns the registered
+// Symbol for key, creating and registering one (with key as its
+// description) if this is the first time key has been seen.
+func SymbolFor(key string) Symbol {
+	symbolRegistryMu.Lock()
+	defer symbolRegistryMu.Unlock()
+	if sym, ok := symbolRegistry[key]; ok {
+		return sym
+	}
+	sym := NewSymbol(key)
+	symbolRegistry[key] = sym
+	return sym
+}
+
+// SymbolKeyFor implements Symbol.keyFor(sym): it returns the key sym
+// was registered under via SymbolFor, and ok == true - or ok == false
+// if sym was never registered (e.g. it came from NewSymbol directly,
+// or is a well-known symbol).
+func SymbolKeyFor(sym Symbol) (key string, ok bool) {
+	symbolRegistryMu.Lock()
+	defer symbolRegistryMu.Unlock()
+	for k, s := range symbolRegistry {
+		if s == sym {
+			return k, true
+		}
+	}
+	return "", false
+}
+
+/********************************************************************/
+// Well-known symbols (ES2015 6.1.5.1): singletons used by the
+// language itself (e.g. for-of consults @@iterator) rather than
+// created via Symbol() or looked up via Symbol.for().  They are never
+// placed in symbolRegistry: Symbol.keyFor(Symbol.iterator) must
+// return undefined, just as it does for any other unregistered
+// Symbol.
+
+var (
+	SymbolIterator    = NewSymbol("Symbol.iterator")
+	SymbolToPrimitive = NewSymbol("Symbol.toPrimitive")
+	SymbolToStringTag = NewSymbol("Symbol.toStringTag")
+)
@@ -0,0 +1,1552 @@
+/* Copyright 2017 Google Inc.
+ * https://github.com/NeilFraser/CodeCity
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package interpreter
+
+// This file implements Snapshot/Restore: freezing a live Interpreter -
+// its current continuation (the chain of state<Foo> objects reachable
+// from Interpreter.state via .parent), every scope reachable from
+// those states (with shared parents deduplicated via an integer id,
+// the way e.g. modernc.org/cc's AST externalizes its symbol tables by
+// index rather than by repeating them), and the values those scopes
+// hold - into a self-describing byte stream that Restore can turn back
+// into an equivalent Interpreter, ready to Step/Run from exactly where
+// it left off.
+//
+// The format is a straightforward tagged binary encoding, not gob:
+// every struct of interest in this package (scope, binding, state<Foo>,
+// lvalue, completion) uses unexported fields, which gob's reflection-
+// based encoder cannot see.  Since encoder and decoder both live here,
+// in the same package, they can read and write those fields directly.
+//
+// Each concrete state<Foo> type registers an (encode, decode) pair
+// under its own stateTag at init, in registerStateCodec calls grouped
+// just below newState's switch in spirit (see the init function
+// below) - so extending newState with a new AST node type
+// means adding a matching codec here, the same way isStatementNode
+// already has to be kept in sync with it.
+//
+// A state<Foo>'s own fields are, for the most part, plain scalars
+// (ints, strings, bools), completions, and object.Values - all encoded
+// directly - except for the ones that point into the AST the program
+// was parsed from (e.g. stateBlockStatement.body, stateIfStatement.
+// consequent).  Rather than serialize the AST itself, Snapshot stores
+// only the start offset of each such node (the same identity coverage
+// uses to key its hit-count maps) plus, once per snapshot, the
+// original astJSON; Restore re-parses that JSON and re-derives a
+// start-offset index over it (buildNodeIndex) to resolve those
+// references back into live *ast.Node values.  This assumes the
+// program's source hasn't changed between Snapshot and Restore, which
+// is the only case that makes sense for resuming a checkpoint of the
+// same running program.
+//
+// Limitations, called out explicitly (rather than silently producing
+// a wrong result) where Snapshot encounters them: an Interpreter
+// created via NewModule (whose world spans several linked module
+// sources, not one retained astJSON) cannot be snapshotted yet; nor
+// can a live *object.Object - e.g. a stateObjectExpression caught
+// mid-construction, or any non-primitive object.Value reachable from a
+// scope's bindings - since the object package's property/prototype
+// representation doesn't yet have a codec here.  Both cases return a
+// descriptive error rather than a truncated or incorrect snapshot.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+
+	"CodeCity/server/interpreter/ast"
+	"CodeCity/server/interpreter/coverage"
+	"CodeCity/server/interpreter/object"
+)
+
+/********************************************************************/
+// Low-level tagged binary encoding.
+
+type snapshotWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *snapshotWriter) writeByte(b byte) {
+	w.buf.WriteByte(b)
+}
+
+func (w *snapshotWriter) writeBool(b bool) {
+	if b {
+		w.writeByte(1)
+	} else {
+		w.writeByte(0)
+	}
+}
+
+func (w *snapshotWriter) writeInt(n int) {
+	var tmp [binary.MaxVarintLen64]byte
+	l := binary.PutVarint(tmp[:], int64(n))
+	w.buf.Write(tmp[:l])
+}
+
+func (w *snapshotWriter) writeFloat64(f float64) {
+	var tmp [8]byte
+	binary.BigEndian.PutUint64(tmp[:], math.Float64bits(f))
+	w.buf.Write(tmp[:])
+}
+
+func (w *snapshotWriter) writeString(s string) {
+	w.writeInt(len(s))
+	w.buf.WriteString(s)
+}
+
+// writeNodeRef records a reference to an AST node by its source start
+// offset, or -1 for a nil node; see buildNodeIndex for how Restore
+// resolves it back into an ast.Node.
+func (w *snapshotWriter) writeNodeRef(n ast.Node) {
+	if n == nil {
+		w.writeInt(-1)
+		return
+	}
+	w.writeInt(n.Start())
+}
+
+type snapshotReader struct {
+	buf *bytes.Reader
+}
+
+func (r *snapshotReader) readByte() (byte, error) {
+	return r.buf.ReadByte()
+}
+
+func (r *snapshotReader) readBool() (bool, error) {
+	b, err := r.readByte()
+	return b != 0, err
+}
+
+func (r *snapshotReader) readInt() (int, error) {
+	n, err := binary.ReadVarint(r.buf)
+	return int(n), err
+}
+
+func (r *snapshotReader) readFloat64() (float64, error) {
+	var tmp [8]byte
+	if _, err := io.ReadFull(r.buf, tmp[:]); err != nil {
+		return 0, err
+	}
+	return math.Float64frombits(binary.BigEndian.Uint64(tmp[:])), nil
+}
+
+func (r *snapshotReader) readString() (string, error) {
+	n, err := r.readInt()
+	if err != nil {
+		return "", err
+	}
+	tmp := make([]byte, n)
+	if _, err := io.ReadFull(r.buf, tmp); err != nil {
+		return "", err
+	}
+	return string(tmp), nil
+}
+
+func (r *snapshotReader) readNodeRef(idx map[int]ast.Node) (ast.Node, error) {
+	start, err := r.readInt()
+	if err != nil {
+		return nil, err
+	}
+	if start < 0 {
+		return nil, nil
+	}
+	n, ok := idx[start]
+	if !ok {
+		return nil, fmt.Errorf("no AST node at offset %d (has the source changed since Snapshot?)", start)
+	}
+	return n, nil
+}
+
+/********************************************************************/
+// object.Value encoding.  Only Undefined, Null, Boolean, Number and
+// String Values are supported; anything else (a live *object.Object,
+// but also a BigInt or a Symbol) makes writeValue return an error.
+
+type valueTag byte
+
+const (
+	valNil valueTag = iota
+	valUndefined
+	valNull
+	valBoolean
+	valNumber
+	valString
+)
+
+func (w *snapshotWriter) writeValue(v object.Value) error {
+	switch val := v.(type) {
+	case nil:
+		w.writeByte(byte(valNil))
+	case object.Undefined:
+		w.writeByte(byte(valUndefined))
+	case object.Null:
+		w.writeByte(byte(valNull))
+	case object.Boolean:
+		w.writeByte(byte(valBoolean))
+		w.writeBool(bool(val))
+	case object.Number:
+		w.writeByte(byte(valNumber))
+		w.writeFloat64(float64(val))
+	case object.String:
+		w.writeByte(byte(valString))
+		w.writeString(string(val))
+	default:
+		return fmt.Errorf("cannot snapshot a %T: object-graph serialization "+
+			"(prototype chains, property descriptors) is not implemented yet", v)
+	}
+	return nil
+}
+
+func (r *snapshotReader) readValue() (object.Value, error) {
+	tag, err := r.readByte()
+	if err != nil {
+		return nil, err
+	}
+	switch valueTag(tag) {
+	case valNil:
+		return nil, nil
+	case valUndefined:
+		return object.Undefined{}, nil
+	case valNull:
+		return object.Null{}, nil
+	case valBoolean:
+		b, err := r.readBool()
+		return object.Boolean(b), err
+	case valNumber:
+		f, err := r.readFloat64()
+		return object.Number(f), err
+	case valString:
+		s, err := r.readString()
+		return object.String(s), err
+	default:
+		return nil, fmt.Errorf("unknown value tag %d", tag)
+	}
+}
+
+/********************************************************************/
+// completion encoding.
+
+func (w *snapshotWriter) writeCompletion(c completion) error {
+	w.writeInt(int(c.typ))
+	if err := w.writeValue(c.value); err != nil {
+		return err
+	}
+	w.writeString(c.label)
+	return nil
+}
+
+func (r *snapshotReader) readCompletion() (completion, error) {
+	typ, err := r.readInt()
+	if err != nil {
+		return completion{}, err
+	}
+	value, err := r.readValue()
+	if err != nil {
+		return completion{}, err
+	}
+	label, err := r.readString()
+	if err != nil {
+		return completion{}, err
+	}
+	return completion{typ: completionType(typ), value: value, label: label}, nil
+}
+
+/********************************************************************/
+// lvalue encoding.  lvalue is not itself registered as a state<Foo> -
+// it is only ever reached embedded inside stateAssignmentExpression.left
+// or stateUpdateExpression.arg - so its (de)serialization is a plain
+// helper called from those two codecs, not a codec of its own.
+
+func encodeLvalue(w *snapshotWriter, lv *lvalue) error {
+	w.writeInt(int(lv.kind))
+	switch lv.kind {
+	case identName:
+		w.writeString(lv.name)
+	case objectProperty:
+		w.writeNodeRef(ast.Node(lv.objExpr.E))
+		w.writeBool(lv.computed)
+		if lv.computed {
+			w.writeNodeRef(ast.Node(lv.keyExpr.E))
+		} else {
+			w.writeString(lv.keyName)
+		}
+		w.writeBool(lv.haveObj)
+		if lv.haveObj {
+			if err := w.writeValue(lv.obj); err != nil {
+				return fmt.Errorf("object: %v", err)
+			}
+		}
+		w.writeBool(lv.haveKey)
+		if lv.haveKey {
+			if err := w.writeValue(lv.key); err != nil {
+				return fmt.Errorf("key: %v", err)
+			}
+		}
+	}
+	w.writeBool(lv.ready)
+	return nil
+}
+
+func decodeLvalue(r *snapshotReader, scope *scope, idx map[int]ast.Node) (lvalue, error) {
+	var lv lvalue
+	lv.scope = scope
+	kind, err := r.readInt()
+	if err != nil {
+		return lv, err
+	}
+	lv.kind = lvalueKind(kind)
+	switch lv.kind {
+	case identName:
+		if lv.name, err = r.readString(); err != nil {
+			return lv, err
+		}
+	case objectProperty:
+		objNode, err := r.readNodeRef(idx)
+		if err != nil {
+			return lv, err
+		}
+		lv.objExpr = ast.Expression{E: objNode}
+		if lv.computed, err = r.readBool(); err != nil {
+			return lv, err
+		}
+		if lv.computed {
+			keyNode, err := r.readNodeRef(idx)
+			if err != nil {
+				return lv, err
+			}
+			lv.keyExpr = ast.Expression{E: keyNode}
+		} else if lv.keyName, err = r.readString(); err != nil {
+			return lv, err
+		}
+		if lv.haveObj, err = r.readBool(); err != nil {
+			return lv, err
+		}
+		if lv.haveObj {
+			if lv.obj, err = r.readValue(); err != nil {
+				return lv, fmt.Errorf("object: %v", err)
+			}
+		}
+		if lv.haveKey, err = r.readBool(); err != nil {
+			return lv, err
+		}
+		if lv.haveKey {
+			if lv.key, err = r.readValue(); err != nil {
+				return lv, fmt.Errorf("key: %v", err)
+			}
+		}
+	}
+	if lv.ready, err = r.readBool(); err != nil {
+		return lv, err
+	}
+	return lv, nil
+}
+
+/********************************************************************/
+// scope encoding.  Scopes are collected into a dedupe table keyed by
+// pointer identity and written out parent-first, so that by the time
+// Restore reads scope i it has already rebuilt scope i's parent and
+// funcScope (whose ids are always < i; a scope that is its own
+// funcScope is written as -1).
+
+// common returns this, so that snapshot code can get at a state's
+// embedded stateCommon (parent, scope) without a type switch over
+// every concrete state<Foo>.
+func (this *stateCommon) common() *stateCommon {
+	return this
+}
+
+type commonHolder interface {
+	common() *stateCommon
+}
+
+func commonOf(s state) *stateCommon {
+	return s.(commonHolder).common()
+}
+
+// collectScope assigns s (and, recursively, its as-yet-unassigned
+// ancestors) an id in ids/order, and returns s's id.  It is a no-op,
+// returning the existing id, if s has already been assigned one.
+func collectScope(s *scope, ids map[*scope]int, order *[]*scope) int {
+	if s == nil {
+		return -1
+	}
+	if id, ok := ids[s]; ok {
+		return id
+	}
+	collectScope(s.parent, ids, order)
+	id := len(*order)
+	ids[s] = id
+	*order = append(*order, s)
+	return id
+}
+
+func (w *snapshotWriter) writeScopes(order []*scope, ids map[*scope]int) error {
+	w.writeInt(len(order))
+	for _, s := range order {
+		parentID := -1
+		if s.parent != nil {
+			parentID = ids[s.parent]
+		}
+		w.writeInt(parentID)
+		// A scope that is its own funcScope is written as -1, which
+		// readScopes restores as a self-reference.
+		funcScopeID := -1
+		if s.funcScope != s {
+			funcScopeID = collectScope(s.funcScope, ids, &order)
+		}
+		w.writeInt(funcScopeID)
+		names := make([]string, 0, len(s.vars))
+		for name := range s.vars {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		w.writeInt(len(names))
+		for _, name := range names {
+			b := s.vars[name]
+			w.writeString(name)
+			w.writeInt(int(b.kind))
+			if err := w.writeValue(b.value); err != nil {
+				return fmt.Errorf("scope %d binding %q: %v", ids[s], name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (r *snapshotReader) readScopes(interp *Interpreter) ([]*scope, error) {
+	n, err := r.readInt()
+	if err != nil {
+		return nil, err
+	}
+	scopes := make([]*scope, n)
+	for i := 0; i < n; i++ {
+		parentID, err := r.readInt()
+		if err != nil {
+			return nil, err
+		}
+		funcScopeID, err := r.readInt()
+		if err != nil {
+			return nil, err
+		}
+		varCount, err := r.readInt()
+		if err != nil {
+			return nil, err
+		}
+		s := &scope{vars: make(map[string]*binding, varCount), interpreter: interp}
+		if parentID >= 0 {
+			if parentID >= i {
+				return nil, fmt.Errorf("scope %d: parent id %d was not yet defined", i, parentID)
+			}
+			s.parent = scopes[parentID]
+		}
+		if funcScopeID >= 0 {
+			if funcScopeID >= i {
+				return nil, fmt.Errorf("scope %d: funcScope id %d was not yet defined", i, funcScopeID)
+			}
+			s.funcScope = scopes[funcScopeID]
+		} else {
+			s.funcScope = s
+		}
+		for j := 0; j < varCount; j++ {
+			name, err := r.readString()
+			if err != nil {
+				return nil, err
+			}
+			kind, err := r.readInt()
+			if err != nil {
+				return nil, err
+			}
+			value, err := r.readValue()
+			if err != nil {
+				return nil, fmt.Errorf("scope %d binding %q: %v", i, name, err)
+			}
+			s.vars[name] = &binding{value: value, kind: bindingKind(kind)}
+		}
+		scopes[i] = s
+	}
+	return scopes, nil
+}
+
+/********************************************************************/
+// AST node index, used to resolve the start-offset references written
+// by writeNodeRef back into live *ast.Node values after Restore
+// re-parses the program's retained source.  It only needs to recurse
+// into the node types actually reachable from the state<Foo> types
+// below - the same spanning set isStatementNode and newState care
+// about, plus their non-statement children.
+
+func buildNodeIndex(program *ast.Program) map[int]ast.Node {
+	idx := make(map[int]ast.Node)
+	var visit func(n ast.Node)
+	visit = func(n ast.Node) {
+		if n == nil {
+			return
+		}
+		idx[n.Start()] = n
+		switch t := n.(type) {
+		case *ast.Program:
+			for _, s := range t.Body {
+				visit(s)
+			}
+		case *ast.BlockStatement:
+			for _, s := range t.Body {
+				visit(s)
+			}
+		case *ast.IfStatement:
+			visit(t.Test.E)
+			visit(t.Consequent.S)
+			if t.Alternate.S != nil {
+				visit(t.Alternate.S)
+			}
+		case *ast.LabeledStatement:
+			visit(t.Body.S)
+		case *ast.TryStatement:
+			visit(t.Block)
+			if t.Handler != nil {
+				visit(t.Handler)
+			}
+			if t.Finalizer != nil {
+				visit(t.Finalizer)
+			}
+		case *ast.CatchClause:
+			visit(t.Body)
+		case *ast.VariableDeclaration:
+			for _, d := range t.Declarations {
+				visit(d)
+			}
+		case *ast.VariableDeclarator:
+			if t.Init.E != nil {
+				visit(t.Init.E)
+			}
+		case *ast.ReturnStatement:
+			if t.Argument.E != nil {
+				visit(t.Argument.E)
+			}
+		case *ast.ThrowStatement:
+			visit(t.Argument.E)
+		case *ast.ExpressionStatement:
+			visit(t.Expression.E)
+		case *ast.AssignmentExpression:
+			visit(t.Left.E)
+			visit(t.Right.E)
+		case *ast.BinaryExpression:
+			visit(t.Left.E)
+			visit(t.Right.E)
+		case *ast.ConditionalExpression:
+			visit(t.Test.E)
+			visit(t.Consequent.E)
+			visit(t.Alternate.E)
+		case *ast.UpdateExpression:
+			visit(t.Argument.E)
+		case *ast.ObjectExpression:
+			for _, p := range t.Properties {
+				visit(p)
+			}
+		case *ast.Property:
+			visit(t.Key.N)
+			visit(t.Value.E)
+		case *ast.MemberExpression:
+			visit(t.Object.E)
+			if t.Computed {
+				visit(t.Property.E)
+			}
+		}
+	}
+	visit(program)
+	return idx
+}
+
+/********************************************************************/
+// state<Foo> codec registry.
+
+// stateTag identifies the concrete type of a state in a snapshot, so
+// that Restore's decoder can pick the matching codec without a type
+// switch of its own - a mirror, one entry per case, of newState's
+// switch on *ast.Foo.
+type stateTag byte
+
+const (
+	tagInvalid stateTag = iota
+	tagAssignmentExpression
+	tagBinaryExpression
+	tagBlockStatement
+	tagBreakStatement
+	tagConditionalExpression
+	tagContinueStatement
+	tagEmptyStatement
+	tagExpressionStatement
+	tagFunctionDeclaration
+	tagIdentifier
+	tagIfStatement
+	tagLabeledStatement
+	tagLiteral
+	tagObjectExpression
+	tagReturnStatement
+	tagThrowStatement
+	tagTryStatement
+	tagUpdateExpression
+	tagVariableDeclaration
+	tagVariableDeclarator
+)
+
+type stateEncoder func(w *snapshotWriter, s state, ids map[*scope]int) error
+type stateDecoder func(r *snapshotReader, common stateCommon, idx map[int]ast.Node, scopes []*scope) (state, error)
+
+var stateTagOf = map[reflect.Type]stateTag{}
+var stateEncoders = map[stateTag]stateEncoder{}
+var stateDecoders = map[stateTag]stateDecoder{}
+
+func registerStateCodec(tag stateTag, zero state, enc stateEncoder, dec stateDecoder) {
+	stateTagOf[reflect.TypeOf(zero)] = tag
+	stateEncoders[tag] = enc
+	stateDecoders[tag] = dec
+}
+
+func init() {
+	registerStateCodec(tagAssignmentExpression, &stateAssignmentExpression{},
+		encodeAssignmentExpression, decodeAssignmentExpression)
+	registerStateCodec(tagBinaryExpression, &stateBinaryExpression{},
+		encodeBinaryExpression, decodeBinaryExpression)
+	registerStateCodec(tagBlockStatement, &stateBlockStatement{},
+		encodeBlockStatement, decodeBlockStatement)
+	registerStateCodec(tagBreakStatement, &stateBreakStatement{},
+		encodeBreakStatement, decodeBreakStatement)
+	registerStateCodec(tagConditionalExpression, &stateConditionalExpression{},
+		encodeConditionalExpression, decodeConditionalExpression)
+	registerStateCodec(tagContinueStatement, &stateContinueStatement{},
+		encodeContinueStatement, decodeContinueStatement)
+	registerStateCodec(tagEmptyStatement, &stateEmptyStatement{},
+		encodeEmptyStatement, decodeEmptyStatement)
+	registerStateCodec(tagExpressionStatement, &stateExpressionStatement{},
+		encodeExpressionStatement, decodeExpressionStatement)
+	registerStateCodec(tagFunctionDeclaration, &stateFunctionDeclaration{},
+		encodeFunctionDeclaration, decodeFunctionDeclaration)
+	registerStateCodec(tagIdentifier, &stateIdentifier{},
+		encodeIdentifier, decodeIdentifier)
+	registerStateCodec(tagIfStatement, &stateIfStatement{},
+		encodeIfStatement, decodeIfStatement)
+	registerStateCodec(tagLabeledStatement, &stateLabeledStatement{},
+		encodeLabeledStatement, decodeLabeledStatement)
+	registerStateCodec(tagLiteral, &stateLiteral{},
+		encodeLiteral, decodeLiteral)
+	registerStateCodec(tagObjectExpression, &stateObjectExpression{},
+		encodeObjectExpression, decodeObjectExpression)
+	registerStateCodec(tagReturnStatement, &stateReturnStatement{},
+		encodeReturnStatement, decodeReturnStatement)
+	registerStateCodec(tagThrowStatement, &stateThrowStatement{},
+		encodeThrowStatement, decodeThrowStatement)
+	registerStateCodec(tagTryStatement, &stateTryStatement{},
+		encodeTryStatement, decodeTryStatement)
+	registerStateCodec(tagUpdateExpression, &stateUpdateExpression{},
+		encodeUpdateExpression, decodeUpdateExpression)
+	registerStateCodec(tagVariableDeclaration, &stateVariableDeclaration{},
+		encodeVariableDeclaration, decodeVariableDeclaration)
+	registerStateCodec(tagVariableDeclarator, &stateVariableDeclarator{},
+		encodeVariableDeclarator, decodeVariableDeclarator)
+}
+
+func encodeAssignmentExpression(w *snapshotWriter, s state, ids map[*scope]int) error {
+	this := s.(*stateAssignmentExpression)
+	w.writeString(this.op)
+	if err := encodeLvalue(w, &this.left); err != nil {
+		return fmt.Errorf("left: %v", err)
+	}
+	w.writeNodeRef(ast.Node(this.rNode.E))
+	haveRight := this.right != nil
+	w.writeBool(haveRight)
+	if haveRight {
+		if err := w.writeValue(this.right); err != nil {
+			return fmt.Errorf("right: %v", err)
+		}
+	}
+	return nil
+}
+
+func decodeAssignmentExpression(r *snapshotReader, common stateCommon, idx map[int]ast.Node, scopes []*scope) (state, error) {
+	this := &stateAssignmentExpression{stateCommon: common}
+	var err error
+	if this.op, err = r.readString(); err != nil {
+		return nil, err
+	}
+	if this.left, err = decodeLvalue(r, common.scope, idx); err != nil {
+		return nil, fmt.Errorf("left: %v", err)
+	}
+	rNode, err := r.readNodeRef(idx)
+	if err != nil {
+		return nil, err
+	}
+	this.rNode = ast.Expression{E: rNode}
+	haveRight, err := r.readBool()
+	if err != nil {
+		return nil, err
+	}
+	if haveRight {
+		if this.right, err = r.readValue(); err != nil {
+			return nil, fmt.Errorf("right: %v", err)
+		}
+	}
+	return this, nil
+}
+
+func encodeBinaryExpression(w *snapshotWriter, s state, ids map[*scope]int) error {
+	this := s.(*stateBinaryExpression)
+	w.writeString(this.op)
+	w.writeNodeRef(ast.Node(this.lNode.E))
+	w.writeNodeRef(ast.Node(this.rNode.E))
+	w.writeBool(this.haveLeft)
+	if this.haveLeft {
+		if err := w.writeValue(this.left); err != nil {
+			return fmt.Errorf("left: %v", err)
+		}
+	}
+	w.writeBool(this.haveRight)
+	if this.haveRight {
+		if err := w.writeValue(this.right); err != nil {
+			return fmt.Errorf("right: %v", err)
+		}
+	}
+	return nil
+}
+
+func decodeBinaryExpression(r *snapshotReader, common stateCommon, idx map[int]ast.Node, scopes []*scope) (state, error) {
+	this := &stateBinaryExpression{stateCommon: common}
+	var err error
+	if this.op, err = r.readString(); err != nil {
+		return nil, err
+	}
+	lNode, err := r.readNodeRef(idx)
+	if err != nil {
+		return nil, err
+	}
+	this.lNode = ast.Expression{E: lNode}
+	rNode, err := r.readNodeRef(idx)
+	if err != nil {
+		return nil, err
+	}
+	this.rNode = ast.Expression{E: rNode}
+	if this.haveLeft, err = r.readBool(); err != nil {
+		return nil, err
+	}
+	if this.haveLeft {
+		if this.left, err = r.readValue(); err != nil {
+			return nil, fmt.Errorf("left: %v", err)
+		}
+	}
+	if this.haveRight, err = r.readBool(); err != nil {
+		return nil, err
+	}
+	if this.haveRight {
+		if this.right, err = r.readValue(); err != nil {
+			return nil, fmt.Errorf("right: %v", err)
+		}
+	}
+	return this, nil
+}
+
+func encodeBlockStatement(w *snapshotWriter, s state, ids map[*scope]int) error {
+	this := s.(*stateBlockStatement)
+	w.writeInt(len(this.body))
+	for _, stmt := range this.body {
+		w.writeNodeRef(stmt)
+	}
+	outerID := -1
+	if this.outer != nil {
+		outerID = ids[this.outer]
+	}
+	w.writeInt(outerID)
+	w.writeInt(this.n)
+	if err := w.writeCompletion(this.pending); err != nil {
+		return fmt.Errorf("pending: %v", err)
+	}
+	haveValue := this.value != nil
+	w.writeBool(haveValue)
+	if haveValue {
+		if err := w.writeValue(this.value); err != nil {
+			return fmt.Errorf("value: %v", err)
+		}
+	}
+	return nil
+}
+
+func decodeBlockStatement(r *snapshotReader, common stateCommon, idx map[int]ast.Node, scopes []*scope) (state, error) {
+	this := &stateBlockStatement{stateCommon: common}
+	bodyLen, err := r.readInt()
+	if err != nil {
+		return nil, err
+	}
+	this.body = make(ast.Statements, bodyLen)
+	for i := range this.body {
+		n, err := r.readNodeRef(idx)
+		if err != nil {
+			return nil, err
+		}
+		this.body[i] = n
+	}
+	outerID, err := r.readInt()
+	if err != nil {
+		return nil, err
+	}
+	if outerID >= 0 {
+		if outerID >= len(scopes) {
+			return nil, fmt.Errorf("invalid outer scope id %d", outerID)
+		}
+		this.outer = scopes[outerID]
+	}
+	if this.n, err = r.readInt(); err != nil {
+		return nil, err
+	}
+	if this.pending, err = r.readCompletion(); err != nil {
+		return nil, fmt.Errorf("pending: %v", err)
+	}
+	haveValue, err := r.readBool()
+	if err != nil {
+		return nil, err
+	}
+	if haveValue {
+		if this.value, err = r.readValue(); err != nil {
+			return nil, fmt.Errorf("value: %v", err)
+		}
+	}
+	return this, nil
+}
+
+func encodeBreakStatement(w *snapshotWriter, s state, ids map[*scope]int) error {
+	w.writeString(s.(*stateBreakStatement).label)
+	return nil
+}
+
+func decodeBreakStatement(r *snapshotReader, common stateCommon, idx map[int]ast.Node, scopes []*scope) (state, error) {
+	this := &stateBreakStatement{stateCommon: common}
+	var err error
+	this.label, err = r.readString()
+	return this, err
+}
+
+func encodeConditionalExpression(w *snapshotWriter, s state, ids map[*scope]int) error {
+	this := s.(*stateConditionalExpression)
+	w.writeInt(this.start)
+	w.writeNodeRef(ast.Node(this.test.E))
+	w.writeNodeRef(ast.Node(this.consequent.E))
+	w.writeNodeRef(ast.Node(this.alternate.E))
+	w.writeBool(this.result)
+	w.writeBool(this.haveResult)
+	return nil
+}
+
+func decodeConditionalExpression(r *snapshotReader, common stateCommon, idx map[int]ast.Node, scopes []*scope) (state, error) {
+	this := &stateConditionalExpression{stateCommon: common}
+	var err error
+	if this.start, err = r.readInt(); err != nil {
+		return nil, err
+	}
+	n, err := r.readNodeRef(idx)
+	if err != nil {
+		return nil, err
+	}
+	this.test = ast.Expression{E: n}
+	if n, err = r.readNodeRef(idx); err != nil {
+		return nil, err
+	}
+	this.consequent = ast.Expression{E: n}
+	if n, err = r.readNodeRef(idx); err != nil {
+		return nil, err
+	}
+	this.alternate = ast.Expression{E: n}
+	if this.result, err = r.readBool(); err != nil {
+		return nil, err
+	}
+	this.haveResult, err = r.readBool()
+	return this, err
+}
+
+func encodeContinueStatement(w *snapshotWriter, s state, ids map[*scope]int) error {
+	w.writeString(s.(*stateContinueStatement).label)
+	return nil
+}
+
+func decodeContinueStatement(r *snapshotReader, common stateCommon, idx map[int]ast.Node, scopes []*scope) (state, error) {
+	this := &stateContinueStatement{stateCommon: common}
+	var err error
+	this.label, err = r.readString()
+	return this, err
+}
+
+func encodeEmptyStatement(w *snapshotWriter, s state, ids map[*scope]int) error {
+	return nil
+}
+
+func decodeEmptyStatement(r *snapshotReader, common stateCommon, idx map[int]ast.Node, scopes []*scope) (state, error) {
+	return &stateEmptyStatement{stateCommon: common}, nil
+}
+
+func encodeExpressionStatement(w *snapshotWriter, s state, ids map[*scope]int) error {
+	this := s.(*stateExpressionStatement)
+	w.writeNodeRef(ast.Node(this.expr.E))
+	w.writeBool(this.done)
+	return nil
+}
+
+func decodeExpressionStatement(r *snapshotReader, common stateCommon, idx map[int]ast.Node, scopes []*scope) (state, error) {
+	this := &stateExpressionStatement{stateCommon: common}
+	n, err := r.readNodeRef(idx)
+	if err != nil {
+		return nil, err
+	}
+	this.expr = ast.Expression{E: n}
+	this.done, err = r.readBool()
+	return this, err
+}
+
+func encodeFunctionDeclaration(w *snapshotWriter, s state, ids map[*scope]int) error {
+	return nil
+}
+
+func decodeFunctionDeclaration(r *snapshotReader, common stateCommon, idx map[int]ast.Node, scopes []*scope) (state, error) {
+	return &stateFunctionDeclaration{stateCommon: common}, nil
+}
+
+func encodeIdentifier(w *snapshotWriter, s state, ids map[*scope]int) error {
+	w.writeString(s.(*stateIdentifier).name)
+	return nil
+}
+
+func decodeIdentifier(r *snapshotReader, common stateCommon, idx map[int]ast.Node, scopes []*scope) (state, error) {
+	this := &stateIdentifier{stateCommon: common}
+	var err error
+	this.name, err = r.readString()
+	return this, err
+}
+
+func encodeIfStatement(w *snapshotWriter, s state, ids map[*scope]int) error {
+	this := s.(*stateIfStatement)
+	w.writeInt(this.start)
+	w.writeNodeRef(ast.Node(this.test.E))
+	w.writeNodeRef(this.consequent.S)
+	w.writeNodeRef(this.alternate.S)
+	w.writeBool(this.result)
+	w.writeBool(this.haveResult)
+	return nil
+}
+
+func decodeIfStatement(r *snapshotReader, common stateCommon, idx map[int]ast.Node, scopes []*scope) (state, error) {
+	this := &stateIfStatement{stateCommon: common}
+	var err error
+	if this.start, err = r.readInt(); err != nil {
+		return nil, err
+	}
+	n, err := r.readNodeRef(idx)
+	if err != nil {
+		return nil, err
+	}
+	this.test = ast.Expression{E: n}
+	if n, err = r.readNodeRef(idx); err != nil {
+		return nil, err
+	}
+	this.consequent = ast.Statement{S: n}
+	if n, err = r.readNodeRef(idx); err != nil {
+		return nil, err
+	}
+	this.alternate = ast.Statement{S: n}
+	if this.result, err = r.readBool(); err != nil {
+		return nil, err
+	}
+	this.haveResult, err = r.readBool()
+	return this, err
+}
+
+func encodeLabeledStatement(w *snapshotWriter, s state, ids map[*scope]int) error {
+	this := s.(*stateLabeledStatement)
+	w.writeString(this.label)
+	w.writeNodeRef(this.body.S)
+	w.writeBool(this.started)
+	if err := w.writeCompletion(this.pending); err != nil {
+		return fmt.Errorf("pending: %v", err)
+	}
+	return nil
+}
+
+func decodeLabeledStatement(r *snapshotReader, common stateCommon, idx map[int]ast.Node, scopes []*scope) (state, error) {
+	this := &stateLabeledStatement{stateCommon: common}
+	var err error
+	if this.label, err = r.readString(); err != nil {
+		return nil, err
+	}
+	n, err := r.readNodeRef(idx)
+	if err != nil {
+		return nil, err
+	}
+	this.body = ast.Statement{S: n}
+	if this.started, err = r.readBool(); err != nil {
+		return nil, err
+	}
+	if this.pending, err = r.readCompletion(); err != nil {
+		return nil, fmt.Errorf("pending: %v", err)
+	}
+	return this, nil
+}
+
+func encodeLiteral(w *snapshotWriter, s state, ids map[*scope]int) error {
+	if err := w.writeValue(s.(*stateLiteral).value); err != nil {
+		return fmt.Errorf("value: %v", err)
+	}
+	return nil
+}
+
+func decodeLiteral(r *snapshotReader, common stateCommon, idx map[int]ast.Node, scopes []*scope) (state, error) {
+	this := &stateLiteral{stateCommon: common}
+	v, err := r.readValue()
+	if err != nil {
+		return nil, fmt.Errorf("value: %v", err)
+	}
+	this.value = v
+	return this, nil
+}
+
+func encodeObjectExpression(w *snapshotWriter, s state, ids map[*scope]int) error {
+	this := s.(*stateObjectExpression)
+	if this.obj != nil {
+		return fmt.Errorf("cannot snapshot an object literal mid-construction: " +
+			"object-graph serialization is not implemented yet")
+	}
+	w.writeInt(len(this.props))
+	for _, p := range this.props {
+		w.writeNodeRef(p)
+	}
+	w.writeInt(this.n)
+	w.writeString(this.key)
+	haveValue := this.value != nil
+	w.writeBool(haveValue)
+	if haveValue {
+		if err := w.writeValue(this.value); err != nil {
+			return fmt.Errorf("value: %v", err)
+		}
+	}
+	w.writeBool(this.gotKey)
+	w.writeBool(this.gotValue)
+	return nil
+}
+
+func decodeObjectExpression(r *snapshotReader, common stateCommon, idx map[int]ast.Node, scopes []*scope) (state, error) {
+	this := &stateObjectExpression{stateCommon: common}
+	propCount, err := r.readInt()
+	if err != nil {
+		return nil, err
+	}
+	this.props = make([]*ast.Property, propCount)
+	for i := range this.props {
+		n, err := r.readNodeRef(idx)
+		if err != nil {
+			return nil, err
+		}
+		if n == nil {
+			continue
+		}
+		p, ok := n.(*ast.Property)
+		if !ok {
+			return nil, fmt.Errorf("expected *ast.Property, got %T", n)
+		}
+		this.props[i] = p
+	}
+	if this.n, err = r.readInt(); err != nil {
+		return nil, err
+	}
+	if this.key, err = r.readString(); err != nil {
+		return nil, err
+	}
+	haveValue, err := r.readBool()
+	if err != nil {
+		return nil, err
+	}
+	if haveValue {
+		if this.value, err = r.readValue(); err != nil {
+			return nil, fmt.Errorf("value: %v", err)
+		}
+	}
+	if this.gotKey, err = r.readBool(); err != nil {
+		return nil, err
+	}
+	this.gotValue, err = r.readBool()
+	return this, err
+}
+
+func encodeReturnStatement(w *snapshotWriter, s state, ids map[*scope]int) error {
+	this := s.(*stateReturnStatement)
+	w.writeNodeRef(ast.Node(this.arg.E))
+	haveValue := this.value != nil
+	w.writeBool(haveValue)
+	if haveValue {
+		if err := w.writeValue(this.value); err != nil {
+			return fmt.Errorf("value: %v", err)
+		}
+	}
+	return nil
+}
+
+func decodeReturnStatement(r *snapshotReader, common stateCommon, idx map[int]ast.Node, scopes []*scope) (state, error) {
+	this := &stateReturnStatement{stateCommon: common}
+	n, err := r.readNodeRef(idx)
+	if err != nil {
+		return nil, err
+	}
+	this.arg = ast.Expression{E: n}
+	haveValue, err := r.readBool()
+	if err != nil {
+		return nil, err
+	}
+	if haveValue {
+		if this.value, err = r.readValue(); err != nil {
+			return nil, fmt.Errorf("value: %v", err)
+		}
+	}
+	return this, nil
+}
+
+func encodeThrowStatement(w *snapshotWriter, s state, ids map[*scope]int) error {
+	this := s.(*stateThrowStatement)
+	w.writeNodeRef(ast.Node(this.arg.E))
+	haveValue := this.value != nil
+	w.writeBool(haveValue)
+	if haveValue {
+		if err := w.writeValue(this.value); err != nil {
+			return fmt.Errorf("value: %v", err)
+		}
+	}
+	return nil
+}
+
+func decodeThrowStatement(r *snapshotReader, common stateCommon, idx map[int]ast.Node, scopes []*scope) (state, error) {
+	this := &stateThrowStatement{stateCommon: common}
+	n, err := r.readNodeRef(idx)
+	if err != nil {
+		return nil, err
+	}
+	this.arg = ast.Expression{E: n}
+	haveValue, err := r.readBool()
+	if err != nil {
+		return nil, err
+	}
+	if haveValue {
+		if this.value, err = r.readValue(); err != nil {
+			return nil, fmt.Errorf("value: %v", err)
+		}
+	}
+	return this, nil
+}
+
+func encodeTryStatement(w *snapshotWriter, s state, ids map[*scope]int) error {
+	this := s.(*stateTryStatement)
+	w.writeNodeRef(this.block)
+	w.writeNodeRef(this.handler)
+	w.writeNodeRef(this.finalizer)
+	w.writeInt(int(this.phase))
+	if err := w.writeCompletion(this.pending); err != nil {
+		return fmt.Errorf("pending: %v", err)
+	}
+	if err := w.writeCompletion(this.saved); err != nil {
+		return fmt.Errorf("saved: %v", err)
+	}
+	return nil
+}
+
+func decodeTryStatement(r *snapshotReader, common stateCommon, idx map[int]ast.Node, scopes []*scope) (state, error) {
+	this := &stateTryStatement{stateCommon: common}
+	n, err := r.readNodeRef(idx)
+	if err != nil {
+		return nil, err
+	}
+	if n != nil {
+		block, ok := n.(*ast.BlockStatement)
+		if !ok {
+			return nil, fmt.Errorf("expected *ast.BlockStatement for block, got %T", n)
+		}
+		this.block = block
+	}
+	if n, err = r.readNodeRef(idx); err != nil {
+		return nil, err
+	}
+	if n != nil {
+		handler, ok := n.(*ast.CatchClause)
+		if !ok {
+			return nil, fmt.Errorf("expected *ast.CatchClause for handler, got %T", n)
+		}
+		this.handler = handler
+	}
+	if n, err = r.readNodeRef(idx); err != nil {
+		return nil, err
+	}
+	if n != nil {
+		finalizer, ok := n.(*ast.BlockStatement)
+		if !ok {
+			return nil, fmt.Errorf("expected *ast.BlockStatement for finalizer, got %T", n)
+		}
+		this.finalizer = finalizer
+	}
+	phase, err := r.readInt()
+	if err != nil {
+		return nil, err
+	}
+	this.phase = tryPhase(phase)
+	if this.pending, err = r.readCompletion(); err != nil {
+		return nil, fmt.Errorf("pending: %v", err)
+	}
+	this.saved, err = r.readCompletion()
+	if err != nil {
+		return nil, fmt.Errorf("saved: %v", err)
+	}
+	return this, nil
+}
+
+func encodeUpdateExpression(w *snapshotWriter, s state, ids map[*scope]int) error {
+	this := s.(*stateUpdateExpression)
+	w.writeString(this.op)
+	w.writeBool(this.prefix)
+	if err := encodeLvalue(w, &this.arg); err != nil {
+		return fmt.Errorf("arg: %v", err)
+	}
+	haveOld := this.old != nil
+	w.writeBool(haveOld)
+	if haveOld {
+		if err := w.writeValue(this.old); err != nil {
+			return fmt.Errorf("old: %v", err)
+		}
+	}
+	return nil
+}
+
+func decodeUpdateExpression(r *snapshotReader, common stateCommon, idx map[int]ast.Node, scopes []*scope) (state, error) {
+	this := &stateUpdateExpression{stateCommon: common}
+	var err error
+	if this.op, err = r.readString(); err != nil {
+		return nil, err
+	}
+	if this.prefix, err = r.readBool(); err != nil {
+		return nil, err
+	}
+	if this.arg, err = decodeLvalue(r, common.scope, idx); err != nil {
+		return nil, fmt.Errorf("arg: %v", err)
+	}
+	haveOld, err := r.readBool()
+	if err != nil {
+		return nil, err
+	}
+	if haveOld {
+		if this.old, err = r.readValue(); err != nil {
+			return nil, fmt.Errorf("old: %v", err)
+		}
+	}
+	return this, nil
+}
+
+func encodeVariableDeclaration(w *snapshotWriter, s state, ids map[*scope]int) error {
+	this := s.(*stateVariableDeclaration)
+	w.writeInt(len(this.decls))
+	for _, d := range this.decls {
+		w.writeNodeRef(d)
+	}
+	return nil
+}
+
+func decodeVariableDeclaration(r *snapshotReader, common stateCommon, idx map[int]ast.Node, scopes []*scope) (state, error) {
+	this := &stateVariableDeclaration{stateCommon: common}
+	n, err := r.readInt()
+	if err != nil {
+		return nil, err
+	}
+	this.decls = make([]*ast.VariableDeclarator, n)
+	for i := range this.decls {
+		node, err := r.readNodeRef(idx)
+		if err != nil {
+			return nil, err
+		}
+		if node == nil {
+			continue
+		}
+		d, ok := node.(*ast.VariableDeclarator)
+		if !ok {
+			return nil, fmt.Errorf("expected *ast.VariableDeclarator, got %T", node)
+		}
+		this.decls[i] = d
+	}
+	return this, nil
+}
+
+func encodeVariableDeclarator(w *snapshotWriter, s state, ids map[*scope]int) error {
+	this := s.(*stateVariableDeclarator)
+	w.writeString(this.name)
+	w.writeNodeRef(ast.Node(this.expr.E))
+	haveValue := this.value != nil
+	w.writeBool(haveValue)
+	if haveValue {
+		if err := w.writeValue(this.value); err != nil {
+			return fmt.Errorf("value: %v", err)
+		}
+	}
+	return nil
+}
+
+func decodeVariableDeclarator(r *snapshotReader, common stateCommon, idx map[int]ast.Node, scopes []*scope) (state, error) {
+	this := &stateVariableDeclarator{stateCommon: common}
+	var err error
+	if this.name, err = r.readString(); err != nil {
+		return nil, err
+	}
+	n, err := r.readNodeRef(idx)
+	if err != nil {
+		return nil, err
+	}
+	this.expr = ast.Expression{E: n}
+	haveValue, err := r.readBool()
+	if err != nil {
+		return nil, err
+	}
+	if haveValue {
+		if this.value, err = r.readValue(); err != nil {
+			return nil, fmt.Errorf("value: %v", err)
+		}
+	}
+	return this, nil
+}
+
+/********************************************************************/
+// The continuation chain.  Interpreter.state is the innermost live
+// state; walking .parent from it reaches every other frame, out to
+// the outermost one (whose parent is nil).  The one wrinkle is lvalue:
+// it is reached as a frame in its own right (via lvalue.next, which
+// sets its parent to the owning stateAssignmentExpression or
+// stateUpdateExpression and hands the rest of the evaluation off to a
+// child of lvalue itself) despite being embedded *inside* that owner,
+// not separately heap-allocated.  resolveChainHead recognizes that
+// case and reports the owning frame plus a discriminant identifying
+// which of its embedded lvalues is current, so that the owner (which
+// already fully serializes its embedded lvalue's state regardless) is
+// the only thing actually written to the snapshot for that link.
+
+const (
+	lvalueNone = iota
+	lvalueAssignmentLeft
+	lvalueUpdateArg
+)
+
+func resolveChainHead(s state) (owner state, discriminant int) {
+	lv, ok := s.(*lvalue)
+	if !ok {
+		return s, lvalueNone
+	}
+	switch o := lv.parent.(type) {
+	case *stateAssignmentExpression:
+		if &o.left == lv {
+			return o, lvalueAssignmentLeft
+		}
+	case *stateUpdateExpression:
+		if &o.arg == lv {
+			return o, lvalueUpdateArg
+		}
+	}
+	return lv.parent, lvalueNone
+}
+
+// embeddedLvalueOf returns the live *lvalue that a non-zero
+// discriminant (as produced by resolveChainHead) identifies within
+// owner, restoring the .parent pointer lvalue.next would have set had
+// execution reached it normally.
+func embeddedLvalueOf(owner state, discriminant int) (state, error) {
+	switch discriminant {
+	case lvalueAssignmentLeft:
+		o, ok := owner.(*stateAssignmentExpression)
+		if !ok {
+			return nil, fmt.Errorf("lvalue discriminant on a %T", owner)
+		}
+		o.left.parent = owner
+		return &o.left, nil
+	case lvalueUpdateArg:
+		o, ok := owner.(*stateUpdateExpression)
+		if !ok {
+			return nil, fmt.Errorf("lvalue discriminant on a %T", owner)
+		}
+		o.arg.parent = owner
+		return &o.arg, nil
+	default:
+		return nil, fmt.Errorf("unknown lvalue discriminant %d", discriminant)
+	}
+}
+
+// collectChain walks outward from head, returning the frames actually
+// to be serialized (owners, per resolveChainHead) innermost-first,
+// alongside each one's discriminant (lvalueNone if head itself, not
+// one of its embedded lvalues, was what the chain pointed to there).
+func collectChain(head state) (frames []state, discriminants []int) {
+	for cur := head; cur != nil; {
+		owner, d := resolveChainHead(cur)
+		frames = append(frames, owner)
+		discriminants = append(discriminants, d)
+		cur = commonOf(owner).parent
+	}
+	return frames, discriminants
+}
+
+func (w *snapshotWriter) writeFrame(s state, discriminant int, ids map[*scope]int) error {
+	tag, ok := stateTagOf[reflect.TypeOf(s)]
+	if !ok {
+		return fmt.Errorf("no codec registered for state type %T", s)
+	}
+	w.writeByte(byte(tag))
+	w.writeInt(discriminant)
+	w.writeInt(ids[commonOf(s).scope])
+	return stateEncoders[tag](w, s, ids)
+}
+
+func (r *snapshotReader) readFrame(scopes []*scope, idx map[int]ast.Node, parent state) (state, int, error) {
+	tagByte, err := r.readByte()
+	if err != nil {
+		return nil, 0, err
+	}
+	tag := stateTag(tagByte)
+	discriminant, err := r.readInt()
+	if err != nil {
+		return nil, 0, err
+	}
+	scopeID, err := r.readInt()
+	if err != nil {
+		return nil, 0, err
+	}
+	if scopeID < 0 || scopeID >= len(scopes) {
+		return nil, 0, fmt.Errorf("invalid scope id %d", scopeID)
+	}
+	dec, ok := stateDecoders[tag]
+	if !ok {
+		return nil, 0, fmt.Errorf("unknown state tag %d", tag)
+	}
+	common := stateCommon{parent: parent, scope: scopes[scopeID]}
+	s, err := dec(r, common, idx, scopes)
+	if err != nil {
+		return nil, 0, err
+	}
+	return s, discriminant, nil
+}
+
+/********************************************************************/
+// Public API.
+
+// Snapshot serializes this Interpreter's entire live world - its
+// current continuation, every scope it can reach, and the values
+// those scopes hold - to a self-describing byte stream that Restore
+// can turn back into an equivalent, independently resumable
+// Interpreter.  See the package comment at the top of this file for
+// the format and its limitations.
+func (this *Interpreter) Snapshot() ([]byte, error) {
+	if this.origJSON == "" {
+		return nil, fmt.Errorf("snapshot: this Interpreter retains no source " +
+			"(it was created via NewModule, whose multi-module snapshotting " +
+			"is not yet supported)")
+	}
+	w := &snapshotWriter{}
+	w.writeString(this.origJSON)
+
+	frames, discriminants := collectChain(this.state)
+	for i, j := 0, len(frames)-1; i < j; i, j = i+1, j-1 {
+		frames[i], frames[j] = frames[j], frames[i]
+		discriminants[i], discriminants[j] = discriminants[j], discriminants[i]
+	}
+
+	ids := map[*scope]int{}
+	var order []*scope
+	for _, f := range frames {
+		collectScope(commonOf(f).scope, ids, &order)
+	}
+	if err := w.writeScopes(order, ids); err != nil {
+		return nil, fmt.Errorf("snapshot: %v", err)
+	}
+
+	w.writeInt(len(frames))
+	for i, f := range frames {
+		if err := w.writeFrame(f, discriminants[i], ids); err != nil {
+			return nil, fmt.Errorf("snapshot: frame %d (%T): %v", i, f, err)
+		}
+	}
+
+	w.writeBool(this.Threw)
+	w.writeBool(this.Verbose)
+	if err := w.writeValue(this.value); err != nil {
+		return nil, fmt.Errorf("snapshot: value: %v", err)
+	}
+	return w.buf.Bytes(), nil
+}
+
+// Restore rebuilds an Interpreter from a byte stream produced by
+// Snapshot, ready to Step or Run from exactly where it left off.
+func Restore(data []byte) (*Interpreter, error) {
+	r := &snapshotReader{buf: bytes.NewReader(data)}
+	origJSON, err := r.readString()
+	if err != nil {
+		return nil, fmt.Errorf("restore: source: %v", err)
+	}
+	tree, err := ast.NewFromJSON(origJSON)
+	if err != nil {
+		return nil, fmt.Errorf("restore: reparsing source: %v", err)
+	}
+	program, ok := tree.(*ast.Program)
+	if !ok {
+		return nil, fmt.Errorf("restore: root AST node is %T, not *ast.Program", tree)
+	}
+	idx := buildNodeIndex(program)
+
+	this := new(Interpreter)
+	this.Coverage = coverage.New()
+	this.origJSON = origJSON
+
+	scopes, err := r.readScopes(this)
+	if err != nil {
+		return nil, fmt.Errorf("restore: scopes: %v", err)
+	}
+
+	frameCount, err := r.readInt()
+	if err != nil {
+		return nil, fmt.Errorf("restore: frame count: %v", err)
+	}
+	var parent, effective state
+	for i := 0; i < frameCount; i++ {
+		f, discriminant, err := r.readFrame(scopes, idx, parent)
+		if err != nil {
+			return nil, fmt.Errorf("restore: frame %d: %v", i, err)
+		}
+		effective = f
+		if discriminant != lvalueNone {
+			if effective, err = embeddedLvalueOf(f, discriminant); err != nil {
+				return nil, fmt.Errorf("restore: frame %d: %v", i, err)
+			}
+		}
+		parent = effective
+	}
+	this.state = effective
+
+	if this.Threw, err = r.readBool(); err != nil {
+		return nil, fmt.Errorf("restore: Threw: %v", err)
+	}
+	if this.Verbose, err = r.readBool(); err != nil {
+		return nil, fmt.Errorf("restore: Verbose: %v", err)
+	}
+	if this.value, err = r.readValue(); err != nil {
+		return nil, fmt.Errorf("restore: value: %v", err)
+	}
+	return this, nil
+}